@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const historyOrderBackward = "backward"
+
+// containsRoomCreate checks whether the events include the creation of the room.
+func containsRoomCreate(events []*event.Event) bool {
+	for _, evt := range events {
+		if evt.Type.Type == event.StateCreate.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillRoomMessages paginates the room history backwards from the backfill
+// token (or from the present, if the backfill is just starting) until the
+// creation of the room is reached. On the first backup the token to continue
+// forwards from on later runs is recorded as the next token. The backfill token
+// is saved to the metadata with each chunk, so an interrupted backfill is
+// resumed on the next run. Returns the number of fetched events.
+func backfillRoomMessages(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, meta *Metadata, roomLog zerolog.Logger, media *mediaStore) (int, error) {
+	totalFetched := 0
+	currentToken := meta.BackfillToken
+	reanchored := false
+	for {
+		roomLog.Debug().Str("direction", string(mautrix.DirectionBackward)).Str("token", currentToken).Int("limit", fetchLimit).Msg("Fetching messages")
+		resp, err := client.Messages(ctx, roomID, currentToken, "", mautrix.DirectionBackward, nil, fetchLimit)
+		if err != nil && currentToken != "" && !reanchored && isInvalidTokenError(err) {
+			reanchored = true
+			var newToken string
+			var fetched int
+			newToken, fetched, err = handleInvalidToken(ctx, client, roomID, store, roomDirName, mautrix.DirectionBackward, meta, roomLog, media)
+			totalFetched += fetched
+			if err == nil {
+				currentToken = newToken
+				continue
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				roomLog.Error().Err(err).Msg("Failed to fetch messages")
+			}
+			return totalFetched, err
+		}
+		roomLog.Debug().Int("count", len(resp.Chunk)).Str("start_token", resp.Start).Str("end_token", resp.End).Msg("Fetched message chunk")
+
+		if meta.NextToken == "" {
+			// Events newer than the start of the backfill are fetched forwards
+			meta.NextToken = resp.Start
+		}
+		// The end token is omitted when there is no older history
+		done := len(resp.Chunk) == 0 || resp.End == "" || resp.End == currentToken || containsRoomCreate(resp.Chunk)
+		if done {
+			meta.BackfillToken = ""
+		} else {
+			meta.BackfillToken = resp.End
+		}
+		if err := processMessageChunk(ctx, client, roomID, store, roomDirName, resp.Chunk, meta, roomLog, media); err != nil {
+			return totalFetched, err
+		}
+		totalFetched += len(resp.Chunk)
+		if done {
+			roomLog.Debug().Msg("Reached start of history")
+			return totalFetched, nil
+		}
+		currentToken = resp.End
+	}
+}
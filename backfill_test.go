@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+)
+
+const testRoomMessagesPath = "/_matrix/client/v3/rooms/!room:example.org/messages"
+
+var testBackfillDay = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+func newTestMessagesEvent(eventID, eventType string, day int) map[string]any {
+	return map[string]any{
+		"event_id": eventID, "type": eventType, "sender": "@user:example.org", "room_id": testRoomID,
+		"origin_server_ts": testBackfillDay.AddDate(0, 0, day).UnixMilli(), "content": map[string]any{},
+	}
+}
+
+func TestBackfillRoomMessages(t *testing.T) {
+	ctx := context.Background()
+	server, _ := newTestHomeserver(t, map[string]any{
+		"b:":    map[string]any{"start": "now", "end": "b1", "chunk": []any{newTestMessagesEvent("$recent", "m.room.message", 2)}},
+		"b:b1":  testFailOnce{map[string]any{"start": "b1", "end": "b2", "chunk": []any{newTestMessagesEvent("$older", "m.room.message", 1)}}},
+		"b:b2":  map[string]any{"start": "b2", "end": "b3", "chunk": []any{newTestMessagesEvent("$create", "m.room.create", 0)}},
+		"f:now": map[string]any{"start": "now", "chunk": []any{}},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	roomDirName := "Room:" + testRoomID.String()
+	roomPath := filepath.Join(backupDir, roomDirName)
+	cli := &CLI{HistoryOrder: historyOrderBackward}
+
+	// The recent day is written before the backfill is interrupted
+	meta := &Metadata{}
+	fetched, err := backupRoomMessages(ctx, client, testRoomID, store, roomDirName, meta, zerolog.Nop(), cli, nil)
+	assert.ErrorContains(t, err, "Internal error")
+	assert.Equal(t, fetched, 1)
+	assert.Assert(t, fileExists(filepath.Join(roomPath, "2024-01-17.json")))
+	meta, err = store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, meta, &Metadata{NextToken: "now", BackfillToken: "b1"})
+
+	// The next run resumes the backfill until the creation of the room
+	fetched, err = backupRoomMessages(ctx, client, testRoomID, store, roomDirName, meta, zerolog.Nop(), cli, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, fetched, 2)
+	assert.Assert(t, fileExists(filepath.Join(roomPath, "2024-01-16.json")))
+	assert.Assert(t, fileExists(filepath.Join(roomPath, "2024-01-15.json")))
+	meta, err = store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, meta, &Metadata{NextToken: "now"})
+}
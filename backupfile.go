@@ -1,134 +1,190 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
 const (
-	metadataFilename = "metadata.json"
-	dataFilename     = "data.json"
+	metadataFilename  = "metadata.json"
+	dataFilename      = "data.json"
+	dayFormat         = "2006-01-02"
+	corruptFileSuffix = ".corrupt-" // Followed by the time the file was quarantined
+	corruptTimeFormat = "20060102T150405Z"
 )
 
 type Metadata struct {
-	NextToken string `json:"next_token"` // Token to use for the 'from' parameter in the next /messages request
+	NextToken     string           `json:"next_token"`               // Token to use for the 'from' parameter in the next /messages request
+	BackfillToken string           `json:"backfill_token,omitempty"` // Token to continue the backward backfill of the history from, while it is incomplete
+	Membership    event.Membership `json:"membership,omitempty"`     // Our membership in the room when it was last backed up
+
+	Predecessor id.RoomID `json:"predecessor,omitempty"` // The room this room was upgraded from
+	Successor   id.RoomID `json:"successor,omitempty"`   // The room this room was upgraded to
+}
+
+// quarantineFile moves a corrupted file to the directory, appending the
+// current time to its name, so that it is kept for manual recovery instead of
+// being overwritten. Returns the new path of the file.
+func quarantineFile(path, dir string) (string, error) {
+	quarantinePath := filepath.Join(dir, filepath.Base(path)+corruptFileSuffix+time.Now().UTC().Format(corruptTimeFormat))
+	if err := os.Rename(path, quarantinePath); err != nil {
+		return "", fmt.Errorf("failed to quarantine corrupted file %s: %w", path, err)
+	}
+	return quarantinePath, nil
+}
+
+// isQuarantinedFile checks whether the file name is that of a quarantined file.
+func isQuarantinedFile(name string) bool {
+	return strings.Contains(name, corruptFileSuffix)
 }
 
-// readMetadata loads the metadata file for a room.
-func readMetadata(roomPath string) (*Metadata, error) {
-	metaPath := filepath.Join(roomPath, metadataFilename)
-	data, err := os.ReadFile(metaPath)
+// mergeQuarantinedFiles copies the quarantined files of an old room directory
+// to the target room directory.
+func mergeQuarantinedFiles(ctx context.Context, store backupStorage, oldDirName, targetDirName string) error {
+	names, err := store.ListRoomFiles(ctx, oldDirName)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &Metadata{}, nil // Return empty metadata if file doesn't exist
+		return err
+	}
+	for _, name := range names {
+		if !isQuarantinedFile(name) {
+			continue
+		}
+		if err := copyRoomFile(ctx, store, oldDirName, targetDirName, name); err != nil {
+			return fmt.Errorf("failed to move quarantined file %s: %w", name, err)
 		}
-		return nil, fmt.Errorf("failed to read metadata file %s: %w", metaPath, err)
 	}
+	return nil
+}
 
-	var meta Metadata
-	if err := json.Unmarshal(data, &meta); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata file %s: %w", metaPath, err)
+// copyRoomFile copies the room file of a room to another room.
+func copyRoomFile(ctx context.Context, store backupStorage, fromDirName, toDirName, name string) error {
+	data, err := store.ReadRoomFile(ctx, fromDirName, name)
+	if err != nil || data == nil {
+		return err
 	}
-	return &meta, nil
+	return store.WriteRoomFile(ctx, toDirName, name, data)
 }
 
-// writeMetadata saves the metadata file for a room.
-func writeMetadata(roomPath string, meta *Metadata) error {
-	metaPath := filepath.Join(roomPath, metadataFilename)
-	data, err := json.MarshalIndent(meta, "", "  ")
+// storedEdgeEvent returns the newest (or the oldest) stored event of a room
+// directory, or nil if there are no stored events.
+func storedEdgeEvent(ctx context.Context, store backupStorage, roomDirName string, newest bool) (*event.Event, error) {
+	days, err := store.ListDays(ctx, roomDirName)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
+		return nil, err
 	}
-	if err := os.WriteFile(metaPath, data, 0o644); err != nil {
-		return fmt.Errorf("failed to write metadata file %s: %w", metaPath, err)
+	if newest {
+		slices.Reverse(days)
 	}
-	return nil
+	for _, day := range days {
+		events, err := store.ReadDay(ctx, roomDirName, day)
+		if err != nil {
+			return nil, err
+		}
+		var edge *event.Event
+		for _, evt := range events {
+			if edge == nil || (newest && evt.Timestamp > edge.Timestamp) || (!newest && evt.Timestamp < edge.Timestamp) {
+				edge = evt
+			}
+		}
+		if edge != nil {
+			return edge, nil
+		}
+	}
+	return nil, nil
 }
 
-// processEvents groups events by date and writes them to daily files.
-// As multiple requests can span same day, results are merged.
-func processEvents(roomPath string, events []*event.Event) error {
+// preferredEvent chooses which version of the same event to keep. Newer data
+// wins, except that a decrypted event is never replaced by an encrypted one.
+func preferredEvent(existing, evt *event.Event) *event.Event {
+	if existing != nil && evt.Type.Type == event.EventEncrypted.Type && existing.Type.Type != event.EventEncrypted.Type {
+		return existing
+	}
+	return evt
+}
+
+// groupEventsByDay groups the events by their UTC day (yyyy-mm-dd).
+func groupEventsByDay(events []*event.Event) map[string][]*event.Event {
 	eventsByDate := make(map[string][]*event.Event)
 	for _, evt := range events {
-		// Group by UTC date
-		dateStr := time.UnixMilli(evt.Timestamp).UTC().Format("2006-01-02")
+		dateStr := time.UnixMilli(evt.Timestamp).UTC().Format(dayFormat)
 		eventsByDate[dateStr] = append(eventsByDate[dateStr], evt)
 	}
+	return eventsByDate
+}
 
-	for dateStr, dailyEvents := range eventsByDate {
-		// Construct the path for the daily JSON file directly in the room directory
-		dataPath := filepath.Join(roomPath, dateStr+".json")
-
-		// Read existing data if file exists
-		var existingEvents []*event.Event
-		existingData, err := os.ReadFile(dataPath)
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to read existing data file %s: %w", dataPath, err)
-		}
-		if err == nil {
-			// File exists, try to unmarshal
-			if err := json.Unmarshal(existingData, &existingEvents); err != nil {
-				// Log warning but proceed, potentially overwriting corrupted file
-				log.Warn().Str("path", dataPath).Err(err).Msg("Failed to unmarshal existing data file, will overwrite")
-				existingEvents = nil // Reset slice to ensure overwrite
-			}
-		}
+// mergeDayEvents merges new events of a day with the existing ones, ensuring
+// uniqueness by EventID, and sorts them by timestamp.
+func mergeDayEvents(existingEvents, dailyEvents []*event.Event) []*event.Event {
+	mergedEventsMap := make(map[id.EventID]*event.Event)
+	for _, evt := range existingEvents {
+		mergedEventsMap[evt.ID] = evt
+	}
+	for _, evt := range dailyEvents {
+		mergedEventsMap[evt.ID] = preferredEvent(mergedEventsMap[evt.ID], evt)
+	}
 
-		// Merge new events with existing ones, ensuring uniqueness by EventID
-		mergedEventsMap := make(map[id.EventID]*event.Event)
-		for _, evt := range existingEvents {
-			mergedEventsMap[evt.ID] = evt
-		}
-		for _, evt := range dailyEvents {
-			mergedEventsMap[evt.ID] = evt
-		}
+	// Convert map back to slice
+	finalEvents := make([]*event.Event, 0, len(mergedEventsMap))
+	for _, evt := range mergedEventsMap {
+		finalEvents = append(finalEvents, evt)
+	}
 
-		// Convert map back to slice
-		finalEvents := make([]*event.Event, 0, len(mergedEventsMap))
-		for _, evt := range mergedEventsMap {
-			finalEvents = append(finalEvents, evt)
-		}
+	// Sort events by timestamp for consistency
+	sort.SliceStable(finalEvents, func(i, j int) bool {
+		return finalEvents[i].Timestamp < finalEvents[j].Timestamp
+	})
+	return finalEvents
+}
 
-		// Sort events by timestamp for consistency
-		sort.SliceStable(finalEvents, func(i, j int) bool {
-			return finalEvents[i].Timestamp < finalEvents[j].Timestamp
-		})
+// readDayOrQuarantine returns the stored events of the day. Days which cannot
+// be read are quarantined, and returned as empty so that they are started anew.
+func readDayOrQuarantine(ctx context.Context, store backupStorage, roomDirName, day string) ([]*event.Event, error) {
+	events, err := store.ReadDay(ctx, roomDirName, day)
+	if errors.Is(err, errCorruptDay) {
+		return nil, quarantineCorruptDay(ctx, store, roomDirName, day, err)
+	}
+	return events, err
+}
 
-		// Ensure the room directory exists before writing the file
-		if err := os.MkdirAll(roomPath, 0o755); err != nil {
-			return fmt.Errorf("failed to create room directory %s: %w", roomPath, err)
-		}
+// quarantineCorruptDay keeps the corrupted events of the day aside, so that
+// the day is started anew. readErr is the error of reading the day.
+func quarantineCorruptDay(ctx context.Context, store backupStorage, roomDirName, day string, readErr error) error {
+	quarantinePath, err := store.QuarantineDay(ctx, roomDirName, day)
+	if err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Warn().Str("day", day).Str("quarantine_path", quarantinePath).Err(readErr).Msg("Failed to read existing events of the day, quarantined them")
+	return nil
+}
 
-		// Marshal and write the merged and sorted data
-		mergedData, err := json.MarshalIndent(finalEvents, "", "  ")
+// mergeDays merges the events into the stored days, rewriting the whole days.
+// As multiple requests can span same day, results are merged.
+func mergeDays(ctx context.Context, store backupStorage, roomDirName string, events []*event.Event) error {
+	for dateStr, dailyEvents := range groupEventsByDay(events) {
+		existingEvents, err := readDayOrQuarantine(ctx, store, roomDirName, dateStr)
 		if err != nil {
-			return fmt.Errorf("failed to marshal merged events for date %s: %w", dateStr, err)
+			return err
 		}
-		if err := os.WriteFile(dataPath, mergedData, 0o644); err != nil {
-			return fmt.Errorf("failed to write merged data file %s: %w", dataPath, err)
+		if err := store.WriteDay(ctx, roomDirName, dateStr, mergeDayEvents(existingEvents, dailyEvents)); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// updateMetadataToken saves the new token to the metadata file if it has changed.
-func updateMetadataToken(roomPath string, meta *Metadata, newToken string, roomLog zerolog.Logger) {
-	if newToken != meta.NextToken {
-		meta.NextToken = newToken
-		if err := writeMetadata(roomPath, meta); err != nil {
-			roomLog.Error().Err(err).Msg("Failed to write updated metadata")
-			// Don't return error here, as backup might have partially succeeded
-		} else {
-			roomLog.Debug().Str("token", meta.NextToken).Msg("Updated next sync token")
-		}
-	}
+// processEvents stores the events into the days of the room, leaving the
+// metadata as it is.
+func processEvents(ctx context.Context, store backupStorage, roomDirName string, events []*event.Event) error {
+	return store.StoreEvents(ctx, roomDirName, events, nil)
 }
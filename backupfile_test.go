@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
-	"github.com/rs/zerolog"
 	"gotest.tools/v3/assert"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -29,8 +29,11 @@ func newTestEvent(idStr string, ts int64, content string) *event.Event {
 }
 
 func TestReadWriteMetadata(t *testing.T) {
+	ctx := context.Background()
 	tmpDir := t.TempDir()
-	roomPath := filepath.Join(tmpDir, "testRoom")
+	roomDirName := "testRoom"
+	roomPath := filepath.Join(tmpDir, roomDirName)
+	store := newFileStorage(filepath.Dir(roomPath))
 	err := os.Mkdir(roomPath, 0o755)
 	assert.NilError(t, err)
 
@@ -38,7 +41,7 @@ func TestReadWriteMetadata(t *testing.T) {
 
 	t.Run("Write and Read", func(t *testing.T) {
 		metaToWrite := &Metadata{NextToken: "token123"}
-		err := writeMetadata(roomPath, metaToWrite)
+		err := store.WriteMetadata(ctx, roomDirName, metaToWrite)
 		assert.NilError(t, err)
 
 		// Check file content directly
@@ -50,7 +53,7 @@ func TestReadWriteMetadata(t *testing.T) {
 		assert.Equal(t, string(data), expectedJSON)
 
 		// Read back using readMetadata
-		metaRead, err := readMetadata(roomPath)
+		metaRead, err := store.ReadMetadata(ctx, roomDirName)
 		assert.NilError(t, err)
 		assert.DeepEqual(t, metaRead, metaToWrite)
 	})
@@ -59,7 +62,7 @@ func TestReadWriteMetadata(t *testing.T) {
 		// Ensure file doesn't exist first
 		_ = os.Remove(metaPath)
 
-		metaRead, err := readMetadata(roomPath)
+		metaRead, err := store.ReadMetadata(ctx, roomDirName)
 		assert.NilError(t, err)
 		// Should return empty metadata, not nil
 		assert.Assert(t, metaRead != nil)
@@ -70,16 +73,19 @@ func TestReadWriteMetadata(t *testing.T) {
 		err := os.WriteFile(metaPath, []byte("{invalid json"), 0o644)
 		assert.NilError(t, err)
 
-		metaRead, err := readMetadata(roomPath)
+		metaRead, err := store.ReadMetadata(ctx, roomDirName)
 		assert.ErrorContains(t, err, "failed to unmarshal metadata file")
 		assert.Assert(t, metaRead == nil)
 	})
 }
 
 func TestProcessEvents(t *testing.T) {
+	ctx := context.Background()
 	tmpDir := t.TempDir()
-	roomPath := filepath.Join(tmpDir, "testRoom")
-	// No need to create roomPath beforehand, processEvents should create subdirs
+	roomDirName := "testRoom"
+	roomPath := filepath.Join(tmpDir, roomDirName)
+	store := newFileStorage(filepath.Dir(roomPath))
+	// processEvents creates the room directory
 
 	// Timestamps for specific dates (UTC)
 	ts1 := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC).UnixMilli() // 2024-01-15
@@ -100,7 +106,7 @@ func TestProcessEvents(t *testing.T) {
 	dataPath2 := filepath.Join(roomPath, "2024-01-16.json")
 
 	t.Run("First batch", func(t *testing.T) {
-		err := processEvents(roomPath, events1)
+		err := processEvents(ctx, store, roomDirName, events1)
 		assert.NilError(t, err)
 
 		// Check 2024-01-15
@@ -124,7 +130,7 @@ func TestProcessEvents(t *testing.T) {
 	})
 
 	t.Run("Second batch - merge and sort", func(t *testing.T) {
-		err := processEvents(roomPath, events2)
+		err := processEvents(ctx, store, roomDirName, events2)
 		assert.NilError(t, err)
 
 		// Check 2024-01-15 (should now have evt1 and evt2, sorted)
@@ -151,7 +157,7 @@ func TestProcessEvents(t *testing.T) {
 	t.Run("Process empty events", func(t *testing.T) {
 		// Reset by removing old files
 		_ = os.RemoveAll(roomPath)
-		err := processEvents(roomPath, []*event.Event{})
+		err := processEvents(ctx, store, roomDirName, []*event.Event{})
 		assert.NilError(t, err)
 		// Ensure no directories were created
 		_, err = os.Stat(roomPath)
@@ -164,13 +170,13 @@ func TestProcessEvents(t *testing.T) {
 		// Ensure room path exists for writing the corrupted file
 		err := os.MkdirAll(roomPath, 0o755)
 		assert.NilError(t, err)
-		// Create a corrupted file for 2024-01-15 directly in roomPath
+		// Replace the day file of 2024-01-15 with a corrupted one
 		err = os.WriteFile(dataPath1, []byte("[{invalid json"), 0o644)
 		assert.NilError(t, err)
 
 		// Process new events for the same day
 		newEvents := []*event.Event{newTestEvent("$evt4", ts1+1, "New Data")}
-		err = processEvents(roomPath, newEvents)
+		err = processEvents(ctx, store, roomDirName, newEvents)
 		assert.NilError(t, err) // Should log warning but not fail
 
 		// Check if the file was overwritten correctly
@@ -181,102 +187,75 @@ func TestProcessEvents(t *testing.T) {
 		assert.NilError(t, err)
 		assert.Equal(t, len(readEvents), 1)
 		assert.Equal(t, readEvents[0].ID, id.EventID("$evt4"))
-	})
-}
-
-func TestUpdateMetadataToken(t *testing.T) {
-	tmpDir := t.TempDir()
-	roomPath := filepath.Join(tmpDir, "testRoom")
-	err := os.Mkdir(roomPath, 0o755)
-	assert.NilError(t, err)
-	logger := zerolog.Nop()
-	metaPath := filepath.Join(roomPath, metadataFilename)
 
-	t.Run("Update needed", func(t *testing.T) {
-		meta := &Metadata{NextToken: "old_token"}
-		// Pre-write the initial metadata
-		err := writeMetadata(roomPath, meta)
+		// The corrupted file is kept aside
+		quarantined, err := filepath.Glob(dataPath1 + corruptFileSuffix + "*")
 		assert.NilError(t, err)
-
-		newToken := "new_token"
-		updateMetadataToken(roomPath, meta, newToken, logger)
-
-		// Check internal state
-		assert.Equal(t, meta.NextToken, newToken)
-
-		// Check file content
-		readMeta, err := readMetadata(roomPath)
+		assert.Equal(t, len(quarantined), 1)
+		data, err = os.ReadFile(quarantined[0])
 		assert.NilError(t, err)
-		assert.Equal(t, readMeta.NextToken, newToken)
+		assert.Equal(t, string(data), "[{invalid json")
 	})
+}
 
-	t.Run("No update needed", func(t *testing.T) {
-		currentToken := "current_token"
-		meta := &Metadata{NextToken: currentToken}
-		// Pre-write the initial metadata
-		err := writeMetadata(roomPath, meta)
-		assert.NilError(t, err)
-
-		// Get initial file mod time
-		info, err := os.Stat(metaPath)
-		assert.NilError(t, err)
-		modTimeBefore := info.ModTime()
+func TestProcessEventsKeepsDecrypted(t *testing.T) {
+	ctx := context.Background()
+	roomPath := filepath.Join(t.TempDir(), "testRoom")
+	roomDirName := filepath.Base(roomPath)
+	store := newFileStorage(filepath.Dir(roomPath))
+	ts := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC).UnixMilli()
+	dataPath := filepath.Join(roomPath, "2024-01-15.json")
 
-		// Sleep briefly to ensure mod time can change if file is written
-		time.Sleep(2 * time.Millisecond)
+	decrypted := newTestEvent("$evt1", ts, "Decrypted")
+	err := processEvents(ctx, store, roomDirName, []*event.Event{decrypted})
+	assert.NilError(t, err)
 
-		updateMetadataToken(roomPath, meta, currentToken, logger) // Same token
+	encrypted := &event.Event{ID: "$evt1", Timestamp: ts, Type: event.EventEncrypted}
+	err = processEvents(ctx, store, roomDirName, []*event.Event{encrypted})
+	assert.NilError(t, err)
 
-		// Check internal state
-		assert.Equal(t, meta.NextToken, currentToken)
+	data, err := os.ReadFile(dataPath)
+	assert.NilError(t, err)
+	var readEvents []*event.Event
+	err = json.Unmarshal(data, &readEvents)
+	assert.NilError(t, err)
+	assert.Equal(t, len(readEvents), 1)
+	assert.Equal(t, readEvents[0].Type.Type, event.EventMessage.Type)
+}
 
-		// Check file content (should be unchanged)
-		readMeta, err := readMetadata(roomPath)
+func TestStoreEventsMetadata(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	roomDirName := "testRoom"
+	roomPath := filepath.Join(tmpDir, roomDirName)
+	store := newFileStorage(tmpDir)
+	day := testBackfillDay.UnixMilli()
+
+	t.Run("Events and token", func(t *testing.T) {
+		meta := &Metadata{NextToken: "new_token"}
+		err := store.StoreEvents(ctx, roomDirName, []*event.Event{newTestEvent("$a", day, "a")}, meta)
 		assert.NilError(t, err)
-		assert.Equal(t, readMeta.NextToken, currentToken)
 
-		// Check mod time (should be unchanged)
-		info, err = os.Stat(metaPath)
+		readMeta, err := store.ReadMetadata(ctx, roomDirName)
 		assert.NilError(t, err)
-		modTimeAfter := info.ModTime()
-		assert.Equal(t, modTimeAfter, modTimeBefore)
+		assert.Equal(t, readMeta.NextToken, "new_token")
+		events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+		assert.NilError(t, err)
+		assert.Equal(t, len(events), 1)
 	})
 
 	t.Run("Write fails", func(t *testing.T) {
-		meta := &Metadata{NextToken: "token_before_fail"}
-		newToken := "token_fail"
+		// A directory in place of the day file makes writing the day fail
+		err := os.Mkdir(filepath.Join(roomPath, "2024-01-16.json"), 0o755)
+		assert.NilError(t, err)
+
+		meta := &Metadata{NextToken: "token_fail"}
+		err = store.StoreEvents(ctx, roomDirName, []*event.Event{newTestEvent("$b", day+86400000, "b")}, meta)
+		assert.ErrorContains(t, err, "2024-01-16.json")
 
-		// Make directory read-only to cause write failure
-		err := os.Chmod(roomPath, 0o555)
+		// The token is not saved without the events
+		readMeta, err := store.ReadMetadata(ctx, roomDirName)
 		assert.NilError(t, err)
-		defer func() {
-			// Restore permissions for cleanup
-			_ = os.Chmod(roomPath, 0o755)
-		}()
-
-		// updateMetadataToken should log the error but not return it
-		updateMetadataToken(roomPath, meta, newToken, logger)
-
-		// Internal state should still be updated
-		assert.Equal(t, meta.NextToken, newToken)
-
-		// File content should NOT be updated (verify by trying to read)
-		// Need to make readable again first
-		_ = os.Chmod(roomPath, 0o755)
-		// Write the original state so readMetadata doesn't fail if the file wasn't created
-		_ = os.WriteFile(metaPath, []byte(`{"next_token": "token_before_fail"}`), 0o644)
-
-		readMeta, err := readMetadata(roomPath)
-		assert.NilError(t, err)                                  // Read should succeed now
-		assert.Equal(t, readMeta.NextToken, "token_before_fail") // Should contain the old token
+		assert.Equal(t, readMeta.NextToken, "new_token")
 	})
 }
-
-// Helper function to check if a file exists
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
-	}
-	return !info.IsDir()
-}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+)
+
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// compressions are the supported compressions of the day files, with the
+// extensions appended to the names of the compressed files (yyyy-mm-dd.json.zst).
+var (
+	compressions          = []string{compressNone, compressGzip, compressZstd}
+	compressionExtensions = map[string]string{
+		compressNone: "",
+		compressGzip: ".gz",
+		compressZstd: ".zst",
+	}
+)
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// parseDayFileName returns the day and the compression of a daily event file
+// name (yyyy-mm-dd.json, optionally with a compression extension, or yyyy-mm-dd.jsonl).
+func parseDayFileName(name string) (string, string, bool) {
+	compression := compressNone
+	for _, candidate := range compressions {
+		if extension := compressionExtensions[candidate]; extension != "" && strings.HasSuffix(name, extension) {
+			compression = candidate
+			name = strings.TrimSuffix(name, extension)
+			break
+		}
+	}
+	day, ok := strings.CutSuffix(name, ".json")
+	if !ok && compression == compressNone {
+		day, ok = strings.CutSuffix(name, jsonlExtension)
+	}
+	if !ok {
+		return "", "", false
+	}
+	if _, err := time.Parse(dayFormat, day); err != nil {
+		return "", "", false
+	}
+	return day, compression, true
+}
+
+// compressData compresses the data with the compression.
+func compressData(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case compressGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to compress data: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress data: %w", err)
+		}
+		return buffer.Bytes(), nil
+	case compressZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+// decompressData decompresses the data compressed with the compression.
+func decompressData(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case compressGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		defer reader.Close()
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		return decompressed, nil
+	case compressZstd:
+		decompressed, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		return decompressed, nil
+	default:
+		return data, nil
+	}
+}
+
+// convertBackup rewrites the day files of all rooms in the backup directory
+// with the format given by --day-format and the compression given by
+// --compress. Each day is written in the new form before the old file is
+// removed, so the conversion can be interrupted and run again.
+func convertBackup(ctx context.Context, cli *CLI, logger zerolog.Logger) error {
+	if err := validateStorageOptions(cli); err != nil {
+		return err
+	}
+	store := openDayFileStorage(cli)
+	roomDirNames, err := store.ListRooms(ctx)
+	if err != nil {
+		return err
+	}
+	var convertErrors []string
+	totalConverted := 0
+	for _, dirName := range roomDirNames {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		roomLog := logger.With().Str("room_dir", dirName).Logger()
+		days, err := store.ListDays(ctx, dirName)
+		if err != nil {
+			return err
+		}
+		converted := 0
+		for _, day := range days {
+			if paths := store.existingDayPaths(dirName, day); len(paths) == 1 && paths[0] == store.dayPath(dirName, day) {
+				continue
+			}
+			events, err := store.ReadDay(ctx, dirName, day)
+			if err == nil {
+				err = store.WriteDay(ctx, dirName, day, events)
+			}
+			if err != nil {
+				// Unreadable days are left as they are
+				roomLog.Error().Err(err).Str("day", day).Msg("Failed to convert day file")
+				convertErrors = append(convertErrors, fmt.Sprintf("room %s day %s: %v", dirName, day, err))
+				continue
+			}
+			converted++
+		}
+		if converted > 0 {
+			roomLog.Info().Int("days", converted).Msg("Converted day files")
+		}
+		totalConverted += converted
+	}
+	logger.Info().Int("days", totalConverted).Str("format", cli.DayFormat).Str("compression", cli.Compress).Msg("Conversion finished")
+
+	if len(convertErrors) > 0 {
+		return errors.New("encountered errors during conversion: " + strings.Join(convertErrors, "; "))
+	}
+	return nil
+}
+
+// removeFiles removes the files, ignoring the ones which do not exist.
+func removeFiles(paths []string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove file %s: %w", path, err)
+		}
+	}
+	return nil
+}
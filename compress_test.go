@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestParseDayFileName(t *testing.T) {
+	for name, expected := range map[string][2]string{
+		"2024-01-15.json":     {"2024-01-15", compressNone},
+		"2024-01-15.json.gz":  {"2024-01-15", compressGzip},
+		"2024-01-15.json.zst": {"2024-01-15", compressZstd},
+	} {
+		day, compression, ok := parseDayFileName(name)
+		assert.Assert(t, ok, name)
+		assert.DeepEqual(t, [2]string{day, compression}, expected)
+	}
+	for _, name := range []string{"2024-01-15.zst", "data.json", "metadata.json", "2024-01-15.json.gz.corrupt-20240115T120000Z"} {
+		_, _, ok := parseDayFileName(name)
+		assert.Assert(t, !ok, name)
+	}
+}
+
+func TestCompressedDayFiles(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	roomDirName := "Room:" + testRoomID.String()
+	roomPath := filepath.Join(backupDir, roomDirName)
+	day := testBackfillDay.UnixMilli()
+	legacy := newFileStorage(backupDir)
+	assert.NilError(t, processEvents(ctx, legacy, roomDirName, []*event.Event{newTestEvent("$a", day, "a")}))
+
+	// New events are merged with the legacy file into a compressed one
+	store := newFileStorage(backupDir)
+	store.compression = compressZstd
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "b")}))
+	assert.Assert(t, !fileExists(filepath.Join(roomPath, "2024-01-15.json")))
+	assert.Assert(t, fileExists(filepath.Join(roomPath, "2024-01-15.json.zst")))
+
+	// Files left by an interrupted conversion are read together
+	assert.NilError(t, processEvents(ctx, legacy, roomDirName, []*event.Event{newTestEvent("$c", day+2, "c")}))
+	days, err := store.ListDays(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, days, []string{"2024-01-15"})
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 3)
+
+	// The old directories of the room are merged whatever their compression
+	assert.NilError(t, mergeOldRoomData(ctx, store, testRoomID, "New:"+testRoomID.String(), zerolog.Nop()))
+	timeline, err := readRoomTimeline(ctx, store, "New:"+testRoomID.String())
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 3)
+}
+
+func TestConvertBackup(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	roomDirName := "Room:" + testRoomID.String()
+	roomPath := filepath.Join(backupDir, roomDirName)
+	day := testBackfillDay.UnixMilli()
+	assert.NilError(t, processEvents(ctx, newFileStorage(backupDir), roomDirName, []*event.Event{newTestEvent("$a", day, "a"), newTestEvent("$b", day+86400000, "b")}))
+
+	assert.NilError(t, convertBackup(ctx, &CLI{BackupDir: backupDir, Compress: compressGzip}, zerolog.Nop()))
+	for _, name := range []string{"2024-01-15", "2024-01-16"} {
+		assert.Assert(t, !fileExists(filepath.Join(roomPath, name+".json")))
+		assert.Assert(t, fileExists(filepath.Join(roomPath, name+".json.gz")))
+	}
+
+	assert.NilError(t, convertBackup(ctx, &CLI{BackupDir: backupDir, Compress: compressNone}, zerolog.Nop()))
+	events, err := newFileStorage(backupDir).ReadDay(ctx, roomDirName, "2024-01-16")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Assert(t, fileExists(filepath.Join(roomPath, "2024-01-16.json")))
+	assert.Assert(t, !fileExists(filepath.Join(roomPath, "2024-01-16.json.gz")))
+}
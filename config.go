@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -99,5 +100,43 @@ func loadAndValidateConfig(cli *CLI, logger zerolog.Logger) error {
 		return err
 	}
 
+	if err := validateEncryptionOptions(cli); err != nil {
+		return err
+	}
+
+	if err := validateStorageOptions(cli); err != nil {
+		return err
+	}
+
 	return nil // Configuration is valid
 }
+
+// validateEncryptionOptions checks that the encryption related options are
+// not used with end-to-end encryption disabled.
+func validateEncryptionOptions(cli *CLI) error {
+	if cli.E2EE {
+		return nil
+	}
+	if cli.ImportKeys != "" {
+		return errors.New("--import-keys requires end-to-end encryption (--e2ee)")
+	}
+	if cli.KeyBackup {
+		return errors.New("--key-backup requires end-to-end encryption (--e2ee)")
+	}
+	return nil
+}
+
+// validateStorageOptions checks that the options of the day files are used
+// only with the file storage, and that JSONL day files are not compressed:
+// compressed files cannot be appended to, so each chunk would rewrite the
+// whole day, which is what the JSONL format is for avoiding.
+func validateStorageOptions(cli *CLI) error {
+	dayFileOptions := (cli.Compress != "" && cli.Compress != compressNone) || cli.DayFormat == dayFormatJSONL
+	if dayFileOptions && cli.Storage != "" && cli.Storage != storageFile {
+		return errors.New("--compress and --day-format jsonl require the file storage (--storage file)")
+	}
+	if cli.DayFormat == dayFormatJSONL && cli.Compress != "" && cli.Compress != compressNone {
+		return errors.New("JSONL day files cannot be compressed (--compress)")
+	}
+	return nil
+}
@@ -313,4 +313,21 @@ func TestLoadAndValidateConfig(t *testing.T) {
 		err = loadAndValidateConfig(cli, logger)
 		assert.ErrorContains(t, err, "failed to parse config file")
 	})
+
+	t.Run("Import keys without E2EE", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cli := &CLI{
+			ConfigFile: filepath.Join(tmpDir, "nonexistent.json"),
+			Server:     "cli.server",
+			User:       "cli_user",
+			Token:      "cli_token",
+			ImportKeys: filepath.Join(tmpDir, "keys.txt"),
+		}
+		err := loadAndValidateConfig(cli, logger)
+		assert.ErrorContains(t, err, "--import-keys requires end-to-end encryption")
+
+		cli.E2EE = true
+		err = loadAndValidateConfig(cli, logger)
+		assert.NilError(t, err)
+	})
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The crypto machinery is the OlmMachine of mautrix, which must be built with
+// the goolm tag to use the pure Go olm implementation instead of libolm.
+
+const (
+	cryptoStoreFilename = "crypto.db"
+	pickleKeyFilename   = "crypto-pickle.key"
+	pickleKeyLength     = 32
+
+	// Keys added to the content of stored events. The original encrypted
+	// content is kept alongside the decrypted one, and events which could
+	// not be decrypted are marked with the reason.
+	encryptedContentKey = "fi.iki.fingon.matrixbackup.encrypted"
+	decryptionErrorKey  = "fi.iki.fingon.matrixbackup.decryption_error"
+
+	// Sync filter which excludes everything except to-device events
+	toDeviceSyncFilter = `{"room":{"rooms":[]},"presence":{"types":[]},"account_data":{"types":[]}}`
+)
+
+// accountDeviceIDSecret stores the device the olm account was created for.
+// The device ID column of the account is not updated by the store.
+const accountDeviceIDSecret id.Secret = "fi.iki.fingon.matrixbackup.account_device_id"
+
+var errEncryptionUnsupported = errors.New("encryption is not supported by the backup client")
+
+// cryptoMachine wraps the olm machine used to decrypt room history. It
+// implements mautrix.CryptoHelper so that it can be attached to the client.
+type cryptoMachine struct {
+	client *mautrix.Client
+	mach   *crypto.OlmMachine
+	store  *crypto.SQLCryptoStore
+	log    zerolog.Logger
+
+	olmUsable bool
+
+	lock         sync.Mutex
+	fetchedUsers map[id.UserID]bool
+}
+
+var _ mautrix.CryptoHelper = (*cryptoMachine)(nil)
+
+// readPickleKey reads the key encrypting the crypto store from
+// --pickle-key-file, or from the backup directory. A random key is created
+// if the file does not exist yet.
+func readPickleKey(cli *CLI) ([]byte, error) {
+	path := cli.PickleKeyFile
+	if path == "" {
+		path = filepath.Join(cli.BackupDir, pickleKeyFilename)
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return nil, fmt.Errorf("pickle key file %s is empty", path)
+		}
+		return []byte(key), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read pickle key file %s: %w", path, err)
+	}
+
+	raw := make([]byte, pickleKeyLength)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate pickle key: %w", err)
+	}
+	key := base64.RawStdEncoding.EncodeToString(raw)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create pickle key directory: %w", err)
+	}
+	if err := writeFileAtomic(path, []byte(key+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write pickle key file %s: %w", path, err)
+	}
+	return []byte(key), nil
+}
+
+// loadCryptoMachine opens the crypto store in the backup directory, creating
+// a new olm account if there is none for the client's device yet. The
+// returned function closes the crypto store.
+func loadCryptoMachine(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) (*cryptoMachine, func() error, error) {
+	pickleKey, err := readPickleKey(cli)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(cli.BackupDir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create backup directory %s: %w", cli.BackupDir, err)
+	}
+	dbPath := filepath.Join(cli.BackupDir, cryptoStoreFilename)
+	db, err := dbutil.NewWithDialect(fmt.Sprintf("file:%s?_txlock=immediate&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", dbPath), sqliteDriverName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open crypto store %s: %w", dbPath, err)
+	}
+	machine, err := newCryptoMachine(ctx, client, db, pickleKey, logger)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	return machine, db.Close, nil
+}
+
+// newCryptoMachine creates the olm machine on top of the opened crypto store.
+func newCryptoMachine(ctx context.Context, client *mautrix.Client, db *dbutil.Database, pickleKey []byte, logger zerolog.Logger) (*cryptoMachine, error) {
+	cryptoLog := logger.With().Str("component", "crypto").Logger()
+	// The megolm sessions are stored for the user rather than the device, so
+	// they are kept if the device changes
+	store := crypto.NewSQLCryptoStore(db, dbutil.ZeroLogger(cryptoLog), client.UserID.String(), client.DeviceID, pickleKey)
+	if err := store.DB.Upgrade(ctx); err != nil {
+		return nil, fmt.Errorf("failed to upgrade crypto store: %w", err)
+	}
+
+	// The olm account is tied to the device; start with a new one if the
+	// device changed. The olm sessions of the old account are left in place,
+	// they do not match messages encrypted for the new identity key.
+	accountDeviceID, err := store.GetSecret(ctx, accountDeviceIDSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read olm account device: %w", err)
+	}
+	if accountDeviceID != "" && id.DeviceID(accountDeviceID) != client.DeviceID {
+		cryptoLog.Warn().Str("stored_device_id", accountDeviceID).Str("device_id", client.DeviceID.String()).Msg("Device ID changed, creating new olm account")
+		store.SyncToken = ""
+		if err := store.PutAccount(ctx, crypto.NewOlmAccount()); err != nil {
+			return nil, fmt.Errorf("failed to reset olm account: %w", err)
+		}
+	}
+
+	stateStore, ok := mautrix.NewMemoryStateStore().(crypto.StateStore)
+	if !ok {
+		return nil, errors.New("memory state store does not support encryption")
+	}
+	mach := crypto.NewOlmMachine(client, &cryptoLog, store, stateStore)
+	// History is decrypted in any order and more than once, and the sender
+	// devices are fetched once per run in Decrypt
+	mach.DisableRatchetTracking = true
+	mach.DisableDecryptKeyFetching = true
+	if err := mach.Load(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load olm account: %w", err)
+	}
+	if id.DeviceID(accountDeviceID) != client.DeviceID {
+		if err := store.PutAccount(ctx, mach.GetAccount()); err != nil {
+			return nil, fmt.Errorf("failed to store olm account: %w", err)
+		}
+		if err := store.PutSecret(ctx, accountDeviceIDSecret, client.DeviceID.String()); err != nil {
+			return nil, fmt.Errorf("failed to store olm account device: %w", err)
+		}
+	}
+	return &cryptoMachine{
+		client:       client,
+		mach:         mach,
+		store:        store,
+		log:          cryptoLog,
+		fetchedUsers: make(map[id.UserID]bool),
+	}, nil
+}
+
+// shareKeys makes sure the server knows our device keys. If the device
+// already has keys from some other client (e.g. the one the access token was
+// borrowed from), olm is disabled as nobody will encrypt room keys for us.
+func (self *cryptoMachine) shareKeys(ctx context.Context) error {
+	resp, err := self.client.QueryKeys(ctx, &mautrix.ReqQueryKeys{
+		DeviceKeys: mautrix.DeviceKeysRequest{self.client.UserID: mautrix.DeviceIDList{self.client.DeviceID}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query own device keys: %w", err)
+	}
+	account := self.mach.GetAccount()
+	serverKeys, found := resp.DeviceKeys[self.client.UserID][self.client.DeviceID]
+	switch {
+	case !found:
+		account.Shared = false
+	case serverKeys.Keys.GetCurve25519(self.client.DeviceID) == account.IdentityKey():
+		account.Shared = true
+	default:
+		self.log.Warn().Str("device_id", self.client.DeviceID.String()).Msg("Device already has encryption keys from another client; room keys can not be received, only imported ones are used")
+		return nil
+	}
+	if err := self.mach.ShareKeys(ctx, -1); err != nil {
+		return fmt.Errorf("failed to upload keys: %w", err)
+	}
+	self.olmUsable = true
+	return nil
+}
+
+// syncToDevice fetches the pending to-device events (which contain the room
+// keys sent to us) using a sync that excludes all room data.
+func (self *cryptoMachine) syncToDevice(ctx context.Context) error {
+	for {
+		since, err := self.store.GetNextBatch(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read to-device sync token: %w", err)
+		}
+		resp, err := self.client.FullSyncRequest(ctx, mautrix.ReqSync{Since: since, FilterID: toDeviceSyncFilter})
+		if err != nil {
+			return fmt.Errorf("failed to sync to-device events: %w", err)
+		}
+		if err := self.receiveSync(ctx, resp, since); err != nil {
+			return err
+		}
+		if len(resp.ToDevice.Events) == 0 {
+			return nil
+		}
+	}
+}
+
+// receiveSync handles the to-device events and the one-time key counts of a
+// sync response, which the server does not deliver to syncToDevice again if
+// the sync was made elsewhere.
+func (self *cryptoMachine) receiveSync(ctx context.Context, resp *mautrix.RespSync, since string) error {
+	if !self.olmUsable {
+		return nil
+	}
+	self.mach.ProcessSyncResponse(ctx, resp, since)
+	if err := self.store.PutNextBatch(ctx, resp.NextBatch); err != nil {
+		return fmt.Errorf("failed to store to-device sync token: %w", err)
+	}
+	return nil
+}
+
+// fetchDevices fetches the device keys of the user once per run, so that
+// decrypted events can be checked against the keys of the sending device.
+func (self *cryptoMachine) fetchDevices(ctx context.Context, userID id.UserID) {
+	self.lock.Lock()
+	fetched := self.fetchedUsers[userID]
+	self.fetchedUsers[userID] = true
+	self.lock.Unlock()
+	if fetched || userID == "" {
+		return
+	}
+	if _, err := self.mach.FetchKeys(ctx, []id.UserID{userID}, true); err != nil {
+		self.log.Debug().Err(err).Str("user_id", userID.String()).Msg("Failed to fetch device keys")
+	}
+}
+
+// parseEncryptedContent returns a copy of the m.room.encrypted event with the
+// content parsed, without modifying the event itself.
+func parseEncryptedContent(evt *event.Event) (*event.Event, error) {
+	raw, err := json.Marshal(&evt.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal encrypted content: %w", err)
+	}
+	parsed := *evt
+	parsed.Content = event.Content{VeryRaw: raw}
+	if err := parsed.Content.ParseRaw(event.EventEncrypted); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted content: %w", err)
+	}
+	return &parsed, nil
+}
+
+// Init shares our device keys and fetches room keys sent to us since the last run.
+func (self *cryptoMachine) Init(ctx context.Context) error {
+	if err := self.shareKeys(ctx); err != nil {
+		return err
+	}
+	if !self.olmUsable {
+		return nil
+	}
+	return self.syncToDevice(ctx)
+}
+
+// Decrypt decrypts a megolm encrypted room event. The session must have been
+// received from (or imported with) the sender key of the event, and the keys
+// of the session must match the sender's device if it is known.
+func (self *cryptoMachine) Decrypt(ctx context.Context, evt *event.Event) (*event.Event, error) {
+	encrypted, err := parseEncryptedContent(evt)
+	if err != nil {
+		return nil, err
+	}
+	self.fetchDevices(ctx, evt.Sender)
+	return self.mach.DecryptMegolmEvent(ctx, encrypted)
+}
+
+// Encrypt is not supported, as the backup client never sends messages.
+func (self *cryptoMachine) Encrypt(context.Context, id.RoomID, event.Type, any) (*event.EncryptedEventContent, error) {
+	return nil, errEncryptionUnsupported
+}
+
+// WaitForSession does not wait, as room keys are only fetched during Init.
+func (self *cryptoMachine) WaitForSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, time.Duration) bool {
+	return false
+}
+
+// RequestSession is a no-op; other clients share keys only with verified devices.
+func (self *cryptoMachine) RequestSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, id.UserID, id.DeviceID) {
+}
+
+// initializeCrypto sets up end-to-end encryption support for the client,
+// with the crypto store kept in the backup directory. The returned function
+// closes the crypto store.
+func initializeCrypto(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) (func() error, error) {
+	logger.Info().Msg("Initializing end-to-end encryption support...")
+	machine, closeStore, err := loadCryptoMachine(ctx, client, cli, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupCryptoMachine(ctx, machine, cli, logger); err != nil {
+		return nil, errors.Join(err, closeStore())
+	}
+	client.Crypto = machine
+	return closeStore, nil
+}
+
+// setupCryptoMachine imports the room keys and makes the device ready to
+// receive new ones.
+func setupCryptoMachine(ctx context.Context, machine *cryptoMachine, cli *CLI, logger zerolog.Logger) error {
+	if cli.ImportKeys != "" {
+		if err := importKeyFile(ctx, machine, cli, logger); err != nil {
+			return err
+		}
+	}
+	if cli.KeyBackup {
+		if err := unlockKeyBackup(ctx, machine, cli, logger); err != nil {
+			return fmt.Errorf("failed to unlock key backup: %w", err)
+		}
+	}
+	if err := machine.restoreKeyBackup(ctx); err != nil {
+		// Not fatal, we may still have the keys from earlier runs
+		logger.Warn().Err(err).Msg("Failed to restore room keys from key backup")
+	}
+	if err := machine.Init(ctx); err != nil {
+		return err
+	}
+	logger.Info().Bool("receives_room_keys", machine.olmUsable).Msg("End-to-end encryption initialized")
+	return nil
+}
+
+// contentRaw returns the raw map form of the content, creating it if needed.
+func contentRaw(content *event.Content) map[string]any {
+	if content.Raw == nil {
+		raw := make(map[string]any)
+		if data, err := json.Marshal(content); err == nil {
+			_ = json.Unmarshal(data, &raw)
+		}
+		content.Raw = raw
+	}
+	return content.Raw
+}
+
+// decryptEvents replaces encrypted events with their decrypted form (which
+// keeps the encrypted content too), or marks them with the decryption error.
+// Returns the number of events which remain encrypted.
+func decryptEvents(ctx context.Context, helper mautrix.CryptoHelper, roomID id.RoomID, events []*event.Event, roomLog zerolog.Logger) int {
+	failed := 0
+	for i, evt := range events {
+		if evt.Type.Type != event.EventEncrypted.Type {
+			continue
+		}
+		if evt.RoomID == "" {
+			evt.RoomID = roomID
+		}
+		decrypted, err := helper.Decrypt(ctx, evt)
+		if err != nil {
+			roomLog.Debug().Err(err).Str("event_id", evt.ID.String()).Msg("Failed to decrypt event")
+			contentRaw(&evt.Content)[decryptionErrorKey] = err.Error()
+			failed++
+			continue
+		}
+		original := contentRaw(&evt.Content)
+		delete(original, decryptionErrorKey)
+		contentRaw(&decrypted.Content)[encryptedContentKey] = original
+		events[i] = decrypted
+	}
+	return failed
+}
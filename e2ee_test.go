@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/goolm/session"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testRoomID     = id.RoomID("!room:example.org")
+	testSender     = id.UserID("@sender:example.org")
+	testSenderKey  = id.SenderKey("c2VuZGVyIGN1cnZlMjU1MTkga2V5IG9mIHRoZSB0ZXN")
+	testSigningKey = id.Ed25519("c2VuZGVyIGVkMjU1MTkga2V5IG9mIHRoZSB0ZXN0IGR")
+)
+
+func loadTestCryptoMachine(t *testing.T, server *httptest.Server, deviceID id.DeviceID, backupDir string) *cryptoMachine {
+	t.Helper()
+	client, err := mautrix.NewClient(server.URL, "@user:example.org", "token")
+	assert.NilError(t, err)
+	client.DeviceID = deviceID
+	machine, closeStore, err := loadCryptoMachine(context.Background(), client, &CLI{BackupDir: backupDir}, zerolog.Nop())
+	assert.NilError(t, err)
+	t.Cleanup(func() { assert.NilError(t, closeStore()) })
+	return machine
+}
+
+func newTestCryptoMachine(t *testing.T, backupDir string) *cryptoMachine {
+	t.Helper()
+	server, _ := newTestHomeserver(t, nil)
+	return loadTestCryptoMachine(t, server, "DEVICE", backupDir)
+}
+
+// addTestRoomKey adds the inbound session of an outbound session key as if
+// it was received from the test sender.
+func addTestRoomKey(t *testing.T, machine *cryptoMachine, roomID id.RoomID, sessionKey string) {
+	t.Helper()
+	sess, err := crypto.NewInboundGroupSession(testSenderKey, testSigningKey, roomID, sessionKey, 0, 0, false)
+	assert.NilError(t, err)
+	assert.NilError(t, machine.store.PutGroupSession(context.Background(), sess))
+}
+
+// newTestEncryptedEvent encrypts the given content with the outbound session
+// the same way clients do for m.room.encrypted events.
+func newTestEncryptedEvent(t *testing.T, outbound *session.MegolmOutboundSession, eventID string, ts int64, body string) *event.Event {
+	t.Helper()
+	plaintext, err := json.Marshal(map[string]any{
+		"room_id": testRoomID,
+		"type":    "m.room.message",
+		"content": map[string]any{"msgtype": "m.text", "body": body},
+	})
+	assert.NilError(t, err)
+	ciphertext, err := outbound.Encrypt(plaintext)
+	assert.NilError(t, err)
+	content, err := json.Marshal(map[string]any{
+		"algorithm":  id.AlgorithmMegolmV1,
+		"sender_key": testSenderKey,
+		"session_id": outbound.ID(),
+		"ciphertext": string(ciphertext),
+	})
+	assert.NilError(t, err)
+
+	evt := &event.Event{ID: id.EventID(eventID), Sender: testSender, Timestamp: ts, Type: event.EventEncrypted, RoomID: testRoomID}
+	assert.NilError(t, json.Unmarshal(content, &evt.Content))
+	return evt
+}
+
+func TestCryptoMachineDecrypt(t *testing.T) {
+	ctx := context.Background()
+	machine := newTestCryptoMachine(t, t.TempDir())
+	outbound, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	sessionKey := outbound.Key()
+	evt := newTestEncryptedEvent(t, outbound, "$evt1", 1, "secret")
+
+	t.Run("Unknown session", func(t *testing.T) {
+		_, err := machine.Decrypt(ctx, evt)
+		assert.Assert(t, errors.Is(err, crypto.NoSessionFound))
+	})
+
+	t.Run("Known session", func(t *testing.T) {
+		addTestRoomKey(t, machine, testRoomID, sessionKey)
+		decrypted, err := machine.Decrypt(ctx, evt)
+		assert.NilError(t, err)
+		assert.Equal(t, decrypted.Type.Type, event.EventMessage.Type)
+		assert.Equal(t, decrypted.ID, evt.ID)
+		assert.Equal(t, decrypted.Content.Raw["body"], "secret")
+		assert.Equal(t, evt.Type, event.EventEncrypted)
+
+		// The same event can be decrypted again
+		_, err = machine.Decrypt(ctx, evt)
+		assert.NilError(t, err)
+	})
+
+	t.Run("Wrong sender key", func(t *testing.T) {
+		other := newTestEncryptedEvent(t, outbound, "$evt2", 2, "forged")
+		other.Content.Raw["sender_key"] = "b3RoZXIgY3VydmUyNTUxOSBrZXkgb2YgdGhlIHRlc3Q"
+		_, err := machine.Decrypt(ctx, other)
+		assert.Assert(t, errors.Is(err, crypto.SenderKeyMismatch))
+	})
+
+	t.Run("Wrong room", func(t *testing.T) {
+		addTestRoomKey(t, machine, "!other:example.org", sessionKey)
+		other := *evt
+		other.RoomID = "!other:example.org"
+		_, err := machine.Decrypt(ctx, &other)
+		assert.Assert(t, errors.Is(err, crypto.WrongRoom))
+		addTestRoomKey(t, machine, testRoomID, sessionKey)
+	})
+
+	t.Run("Session keys do not match sender device", func(t *testing.T) {
+		assert.NilError(t, machine.store.PutDevice(ctx, testSender, &id.Device{
+			UserID:      testSender,
+			DeviceID:    "SENDER",
+			IdentityKey: testSenderKey,
+			SigningKey:  "b3RoZXIgZWQyNTUxOSBrZXkgb2YgdGhlIHRlc3QgZGV",
+		}))
+		_, err := machine.Decrypt(ctx, newTestEncryptedEvent(t, outbound, "$evt3", 3, "forged"))
+		assert.Assert(t, errors.Is(err, crypto.DeviceKeyMismatch))
+	})
+}
+
+func TestCryptoMachineSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	server, _ := newTestHomeserver(t, nil)
+	machine := loadTestCryptoMachine(t, server, "DEVICE", backupDir)
+	outbound, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	addTestRoomKey(t, machine, testRoomID, outbound.Key())
+	assert.NilError(t, machine.store.PutNextBatch(ctx, "sync_token"))
+
+	loaded := loadTestCryptoMachine(t, server, "DEVICE", backupDir)
+	syncToken, err := loaded.store.GetNextBatch(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, syncToken, "sync_token")
+	identityKey := machine.mach.GetAccount().IdentityKey()
+	assert.Equal(t, loaded.mach.GetAccount().IdentityKey(), identityKey)
+
+	decrypted, err := loaded.Decrypt(ctx, newTestEncryptedEvent(t, outbound, "$evt1", 1, "persisted"))
+	assert.NilError(t, err)
+	assert.Equal(t, decrypted.Content.Raw["body"], "persisted")
+
+	t.Run("Pickle key", func(t *testing.T) {
+		info, err := os.Stat(filepath.Join(backupDir, pickleKeyFilename))
+		assert.NilError(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0o600))
+
+		pickleKeyFile := filepath.Join(t.TempDir(), "pickle.key")
+		assert.NilError(t, os.WriteFile(pickleKeyFile, []byte("other key\n"), 0o600))
+		client, err := mautrix.NewClient(server.URL, "@user:example.org", "token")
+		assert.NilError(t, err)
+		client.DeviceID = "DEVICE"
+		_, _, err = loadCryptoMachine(ctx, client, &CLI{BackupDir: backupDir, PickleKeyFile: pickleKeyFile}, zerolog.Nop())
+		assert.ErrorContains(t, err, "failed to read olm account device")
+	})
+
+	t.Run("Device change keeps room keys only", func(t *testing.T) {
+		other := loadTestCryptoMachine(t, server, "OTHERDEVICE", backupDir)
+		syncToken, err := other.store.GetNextBatch(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, syncToken, "")
+		otherIdentityKey := other.mach.GetAccount().IdentityKey()
+		assert.Assert(t, otherIdentityKey != identityKey)
+		_, err = other.Decrypt(ctx, newTestEncryptedEvent(t, outbound, "$evt2", 2, "kept"))
+		assert.NilError(t, err)
+
+		// The new account is kept for the new device
+		assert.Equal(t, loadTestCryptoMachine(t, server, "OTHERDEVICE", backupDir).mach.GetAccount().IdentityKey(), otherIdentityKey)
+	})
+}
+
+func TestDecryptEvents(t *testing.T) {
+	machine := newTestCryptoMachine(t, t.TempDir())
+	known, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	unknown, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	addTestRoomKey(t, machine, testRoomID, known.Key())
+
+	events := []*event.Event{
+		newTestEvent("$plain", 1, "plain"),
+		newTestEncryptedEvent(t, known, "$known", 2, "decryptable"),
+		newTestEncryptedEvent(t, unknown, "$unknown", 3, "undecryptable"),
+	}
+	failed := decryptEvents(context.Background(), machine, testRoomID, events, zerolog.Nop())
+	assert.Equal(t, failed, 1)
+
+	assert.Equal(t, events[0].Type, event.EventMessage)
+
+	assert.Equal(t, events[1].Type.Type, event.EventMessage.Type)
+	assert.Equal(t, events[1].Content.Raw["body"], "decryptable")
+	original, ok := events[1].Content.Raw[encryptedContentKey].(map[string]any)
+	assert.Assert(t, ok)
+	assert.Equal(t, original["session_id"], known.ID().String())
+
+	assert.Equal(t, events[2].Type.Type, event.EventEncrypted.Type)
+	assert.Assert(t, events[2].Content.Raw[decryptionErrorKey] != nil)
+
+	t.Run("Decrypted events survive roundtrip", func(t *testing.T) {
+		data, err := json.Marshal(events)
+		assert.NilError(t, err)
+		var readEvents []*event.Event
+		assert.NilError(t, json.Unmarshal(data, &readEvents))
+		assert.Equal(t, readEvents[1].Content.Raw["body"], "decryptable")
+		assert.Assert(t, readEvents[1].Content.Raw[encryptedContentKey] != nil)
+		assert.Assert(t, readEvents[2].Content.Raw[decryptionErrorKey] != nil)
+	})
+}
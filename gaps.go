@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const gapContextLimit = 10 // Number of events to fetch around the start of a gap
+
+var (
+	errGapEndNotFound = errors.New("end of the gap not found in the room timeline")
+	errNoPrevEvents   = errors.New("prev_events not included in the event")
+)
+
+// timelineGap is a range of the stored timeline of a room where events may be
+// missing, between two consecutive stored events.
+type timelineGap struct {
+	Before *event.Event // The last stored event before the gap
+	After  *event.Event // The first stored event after the gap
+}
+
+// readRoomTimeline reads all stored events of a room directory, sorted by timestamp.
+func readRoomTimeline(ctx context.Context, store backupStorage, roomDirName string) ([]*event.Event, error) {
+	days, err := store.ListDays(ctx, roomDirName)
+	if err != nil {
+		return nil, err
+	}
+	var timeline []*event.Event
+	for _, day := range days {
+		events, err := store.ReadDay(ctx, roomDirName, day)
+		if err != nil {
+			return nil, err
+		}
+		timeline = append(timeline, events...)
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Timestamp < timeline[j].Timestamp
+	})
+	return timeline, nil
+}
+
+// fetchPrevEvents fetches the event from the server, and returns the events
+// it references as its prev_events. Returns errNoPrevEvents if the server does
+// not include them in the events of the client-server API (most do not).
+func fetchPrevEvents(ctx context.Context, client *mautrix.Client, roomID id.RoomID, eventID id.EventID) ([]id.EventID, error) {
+	var resp struct {
+		PrevEvents *[]json.RawMessage `json:"prev_events"`
+	}
+	if _, err := client.MakeRequest(ctx, http.MethodGet, client.BuildClientURL("v3", "rooms", roomID, "event", eventID), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch event %s: %w", eventID, err)
+	}
+	if resp.PrevEvents == nil {
+		return nil, errNoPrevEvents
+	}
+	prevEvents := make([]id.EventID, 0, len(*resp.PrevEvents))
+	for _, raw := range *resp.PrevEvents {
+		var prevEvent id.EventID
+		if err := json.Unmarshal(raw, &prevEvent); err != nil {
+			// Rooms of versions 1 and 2 reference the events as [event ID, hashes] pairs
+			var pair []json.RawMessage
+			if err := json.Unmarshal(raw, &pair); err != nil || len(pair) == 0 || json.Unmarshal(pair[0], &prevEvent) != nil {
+				return nil, fmt.Errorf("invalid prev_events in event %s", eventID)
+			}
+		}
+		prevEvents = append(prevEvents, prevEvent)
+	}
+	return prevEvents, nil
+}
+
+// isMissingEvent returns whether the server has the event, which is then
+// missing from the backup. Events the server does not show (e.g. from before
+// the user joined, or rejected ones) are not missing.
+func isMissingEvent(ctx context.Context, client *mautrix.Client, roomID id.RoomID, eventID id.EventID) (bool, error) {
+	if _, err := client.GetEvent(ctx, roomID, eventID); err != nil {
+		if errors.Is(err, mautrix.MNotFound) || errors.Is(err, mautrix.MForbidden) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to fetch event %s: %w", eventID, err)
+	}
+	return true, nil
+}
+
+// findGapCandidates returns the ranges between consecutive stored events where
+// events may be missing. Only the boundaries where the history was likely
+// fetched in separate batches are checked: the first stored event of each day,
+// and consecutive stored events which are further apart than the threshold.
+// There the prev_events of the stored event are fetched from the server, and
+// the ones which are not stored but which the server has make a gap. If the
+// server does not provide them (or the event is not found), the events further
+// apart than the threshold are gaps instead.
+func findGapCandidates(ctx context.Context, client *mautrix.Client, roomID id.RoomID, timeline []*event.Event, stored map[id.EventID]bool, threshold time.Duration, roomLog zerolog.Logger) ([]timelineGap, error) {
+	eventDay := func(evt *event.Event) string {
+		return time.UnixMilli(evt.Timestamp).UTC().Format(dayFormat)
+	}
+	var gaps []timelineGap
+	usePrevEvents := true
+	for i := 1; i < len(timeline); i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		apart := time.Duration(timeline[i].Timestamp-timeline[i-1].Timestamp)*time.Millisecond > threshold
+		if !apart && eventDay(timeline[i]) == eventDay(timeline[i-1]) {
+			continue
+		}
+		if usePrevEvents {
+			prevEvents, err := fetchPrevEvents(ctx, client, roomID, timeline[i].ID)
+			switch {
+			case err == nil:
+				missing := false
+				for _, prevEvent := range prevEvents {
+					if stored[prevEvent] {
+						continue
+					}
+					if missing, err = isMissingEvent(ctx, client, roomID, prevEvent); err != nil {
+						return nil, err
+					}
+					if missing {
+						break
+					}
+				}
+				if missing {
+					gaps = append(gaps, timelineGap{Before: timeline[i-1], After: timeline[i]})
+				}
+				continue
+			case errors.Is(err, errNoPrevEvents):
+				roomLog.Debug().Msg("Server does not provide prev_events, checking the timestamps for gaps")
+				usePrevEvents = false
+			case !errors.Is(err, mautrix.MNotFound):
+				return nil, err
+			}
+		}
+		if apart {
+			gaps = append(gaps, timelineGap{Before: timeline[i-1], After: timeline[i]})
+		}
+	}
+	return gaps, nil
+}
+
+// fillGap looks up the events following the start of the gap in the room
+// timeline (using /context), and writes the ones which are not stored until
+// the end of the gap is reached. Returns the number of missing events written.
+func fillGap(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, gap timelineGap, stored map[id.EventID]bool, roomLog zerolog.Logger, media *mediaStore) (int, error) {
+	resp, err := client.Context(ctx, roomID, gap.Before.ID, nil, gapContextLimit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch context of %s: %w", gap.Before.ID, err)
+	}
+	events, token := resp.EventsAfter, resp.End
+	totalFilled := 0
+	for {
+		var missing []*event.Event
+		reached := false
+		for _, evt := range events {
+			// Stored events past the end of the gap are reached too, if the server order differs from the timestamps
+			if evt.ID == gap.After.ID || (stored[evt.ID] && evt.Timestamp >= gap.After.Timestamp) {
+				reached = true
+				break
+			}
+			if !stored[evt.ID] {
+				missing = append(missing, evt)
+			}
+		}
+		if len(missing) > 0 {
+			if err := processMessageChunk(ctx, client, roomID, store, roomDirName, missing, nil, roomLog, media); err != nil {
+				return totalFilled, err
+			}
+			for _, evt := range missing {
+				stored[evt.ID] = true
+			}
+			totalFilled += len(missing)
+		}
+		if reached {
+			return totalFilled, nil
+		}
+		if len(events) == 0 || token == "" {
+			return totalFilled, errGapEndNotFound
+		}
+		messages, err := client.Messages(ctx, roomID, token, "", mautrix.DirectionForward, nil, fetchLimit)
+		if err != nil {
+			return totalFilled, fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		if messages.End == token {
+			messages.End = ""
+		}
+		events, token = messages.Chunk, messages.End
+	}
+}
+
+// verifyRoomGaps finds the gaps in the stored timeline of a room and fetches
+// the missing events. Returns the number of missing events written, and the
+// gaps which could not be filled.
+func verifyRoomGaps(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, roomLog zerolog.Logger, cli *CLI, media *mediaStore) (int, []timelineGap, error) {
+	timeline, err := readRoomTimeline(ctx, store, roomDirName)
+	if err != nil {
+		return 0, nil, err
+	}
+	stored := make(map[id.EventID]bool, len(timeline))
+	for _, evt := range timeline {
+		stored[evt.ID] = true
+	}
+
+	gaps, err := findGapCandidates(ctx, client, roomID, timeline, stored, cli.GapThreshold, roomLog)
+	if err != nil {
+		return 0, nil, err
+	}
+	totalFilled := 0
+	var unfilled []timelineGap
+	for _, gap := range gaps {
+		gapLog := roomLog.With().Str("from_event", gap.Before.ID.String()).Str("to_event", gap.After.ID.String()).
+			Time("from", time.UnixMilli(gap.Before.Timestamp)).Time("to", time.UnixMilli(gap.After.Timestamp)).Logger()
+		filled, err := fillGap(ctx, client, roomID, store, roomDirName, gap, stored, gapLog, media)
+		totalFilled += filled
+		if err != nil {
+			gapLog.Warn().Err(err).Int("filled", filled).Msg("Failed to fill gap")
+			unfilled = append(unfilled, gap)
+			continue
+		}
+		if filled > 0 {
+			gapLog.Info().Int("filled", filled).Msg("Filled gap")
+		}
+	}
+	return totalFilled, unfilled, finishRoom(ctx, store, roomDirName)
+}
+
+// verifyGaps walks all room directories in the backup directory, and fills
+// the gaps in their stored timelines.
+func verifyGaps(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) error {
+	store, err := openStorage(ctx, cli)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(store, logger)
+	roomDirNames, err := store.ListRooms(ctx)
+	if err != nil {
+		return err
+	}
+	var media *mediaStore
+	if cli.Media {
+		if media, err = openMediaStore(store); err != nil {
+			return err
+		}
+	}
+
+	var verifyErrors []string
+	totalFilled, totalUnfilled := 0, 0
+	for _, dirName := range roomDirNames {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		roomID, ok := roomIDFromDirName(dirName)
+		if !ok {
+			continue
+		}
+		roomLog := logger.With().Str("room_id", roomID.String()).Str("room_dir", dirName).Logger()
+		filled, unfilled, err := verifyRoomGaps(roomLog.WithContext(ctx), client, roomID, store, dirName, roomLog, cli, media)
+		totalFilled += filled
+		totalUnfilled += len(unfilled)
+		if err != nil {
+			roomLog.Error().Err(err).Msg("Failed to verify room")
+			verifyErrors = append(verifyErrors, fmt.Sprintf("room %s: %v", roomID, err))
+			continue
+		}
+		for _, gap := range unfilled {
+			verifyErrors = append(verifyErrors, fmt.Sprintf("room %s: gap between %s and %s not filled", roomID, gap.Before.ID, gap.After.ID))
+		}
+	}
+	logger.Info().Int("filled", totalFilled).Int("unfilled_gaps", totalUnfilled).Msg("Gap verification finished")
+
+	if len(verifyErrors) > 0 {
+		return errors.New("encountered errors during gap verification: " + strings.Join(verifyErrors, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestVerifyRoomGaps(t *testing.T) {
+	ctx := context.Background()
+	store := newFileStorage(t.TempDir())
+	roomDirName := "Room:" + testRoomID.String()
+	day := testBackfillDay.UnixMilli()
+	hour := time.Hour.Milliseconds()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{
+		newTestEvent("$a", day, "a"),
+		newTestEvent("$a2", day+1, "a2"),
+		newTestEvent("$c", day+24*hour, "c"),
+		newTestEvent("$e", day+72*hour, "e"),
+	}))
+	server, _ := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/rooms/!room:example.org/context/$a2": map[string]any{
+			"start": "s1", "end": "t1", "events_after": []any{newTestMessagesEvent("$b", "m.room.message", 0)},
+		},
+		testRoomMessagesPath: map[string]any{
+			"start": "t1", "end": "t2", "chunk": []any{newTestMessagesEvent("$b2", "m.room.message", 0), newTestMessagesEvent("$c", "m.room.message", 1)},
+		},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	cli := &CLI{GapThreshold: time.Hour}
+
+	// The context of $c is not found, so the gap after it is not filled
+	filled, unfilled, err := verifyRoomGaps(ctx, client, testRoomID, store, roomDirName, zerolog.Nop(), cli, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, filled, 2)
+	assert.Equal(t, len(unfilled), 1)
+	assert.Equal(t, unfilled[0].Before.ID.String(), "$c")
+	assert.Equal(t, unfilled[0].After.ID.String(), "$e")
+
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 4)
+	timeline, err := readRoomTimeline(ctx, store, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 6)
+}
+
+func TestVerifyRoomGapsPrevEvents(t *testing.T) {
+	ctx := context.Background()
+	store := newFileStorage(t.TempDir())
+	roomDirName := "Room:" + testRoomID.String()
+	day := testBackfillDay.UnixMilli()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{
+		newTestEvent("$a", day, "a"),
+		newTestEvent("$b", day+1, "b"),
+		newTestEvent("$d", day+86400000, "d"),
+		newTestEvent("$f", day+2*86400000, "f"),
+	}))
+	server, requests := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/rooms/!room:example.org/event/$d": map[string]any{"event_id": "$d", "prev_events": []any{[]any{"$b", map[string]any{}}, "$c"}},
+		"/_matrix/client/v3/rooms/!room:example.org/event/$c": newTestMessagesEvent("$c", "m.room.message", 0),
+		"/_matrix/client/v3/rooms/!room:example.org/event/$f": map[string]any{"event_id": "$f", "prev_events": []any{"$e"}},
+		"/_matrix/client/v3/rooms/!room:example.org/event/$e": mautrix.MForbidden.WithMessage("Not visible"),
+		"/_matrix/client/v3/rooms/!room:example.org/context/$b": map[string]any{
+			"start": "s1", "events_after": []any{newTestMessagesEvent("$c", "m.room.message", 0), newTestMessagesEvent("$d", "m.room.message", 1)},
+		},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+
+	// The days are within the threshold, but $d references a missing event,
+	// while the event referenced by $f is not visible to the user
+	filled, unfilled, err := verifyRoomGaps(ctx, client, testRoomID, store, roomDirName, zerolog.Nop(), &CLI{GapThreshold: 48 * time.Hour}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, filled, 1)
+	assert.Equal(t, len(unfilled), 0)
+	timeline, err := readRoomTimeline(ctx, store, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 5)
+
+	// Only the first events of the days are fetched
+	assert.Equal(t, requests.count("/_matrix/client/v3/rooms/!room:example.org/event/$b"), 0)
+	assert.Equal(t, requests.count("/_matrix/client/v3/rooms/!room:example.org/event/$d"), 1)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	dayFormatJSONL = "jsonl"
+	jsonlExtension = ".jsonl"
+)
+
+// parseJSONLEvents parses the events of a JSONL day file, an event per line.
+// Later lines are newer versions of the events of earlier lines. An
+// unterminated last line is a write interrupted before the token of the chunk
+// was saved, so it is ignored.
+func parseJSONLEvents(dataPath string, data []byte) ([]*event.Event, error) {
+	var events []*event.Event
+	for line := range bytes.Lines(data[:bytes.LastIndexByte(data, '\n')+1]) {
+		var evt event.Event
+		if err := json.Unmarshal(line, &evt); err != nil {
+			return nil, fmt.Errorf("%w %s: %w", errCorruptDay, dataPath, err)
+		}
+		events = append(events, &evt)
+	}
+	return mergeDayEvents(nil, events), nil
+}
+
+// marshalJSONLEvents returns the events as JSONL, an event per line.
+func marshalJSONLEvents(events []*event.Event) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, evt := range events {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal event %s: %w", evt.ID, err)
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes(), nil
+}
+
+// jsonlIndexCacheSize is how many indexes of day files are kept in memory.
+// Appends go mostly to the newest day of each room, so this is plenty for the
+// parallel room backups.
+const jsonlIndexCacheSize = 64
+
+// jsonlDayIndex is the index of the events in a JSONL day file, for
+// deciding which new events to append to it.
+type jsonlDayIndex struct {
+	path          string
+	types         map[id.EventID]string // Event types by event ID
+	lastTimestamp int64
+}
+
+// jsonlIndexEntry is the part of an event needed by the index.
+type jsonlIndexEntry struct {
+	ID        id.EventID `json:"event_id"`
+	Type      string     `json:"type"`
+	Timestamp int64      `json:"origin_server_ts"`
+}
+
+func newJSONLDayIndex(dataPath string, events []*event.Event) *jsonlDayIndex {
+	index := &jsonlDayIndex{path: dataPath, types: make(map[id.EventID]string, len(events))}
+	for _, evt := range events {
+		index.add(evt.ID, evt.Type.Type, evt.Timestamp)
+	}
+	return index
+}
+
+// add adds the event to the index, returning false if the file is not
+// compacted anymore, as the event is older than the stored ones or a new
+// version of a stored event.
+func (self *jsonlDayIndex) add(eventID id.EventID, eventType string, timestamp int64) bool {
+	_, stored := self.types[eventID]
+	compacted := !stored && timestamp >= self.lastTimestamp
+	self.types[eventID] = eventType
+	self.lastTimestamp = max(self.lastTimestamp, timestamp)
+	return compacted
+}
+
+// indexJSONLDay returns the index of the complete lines of the JSONL day
+// file, and whether the file is compacted.
+func indexJSONLDay(dataPath string, data []byte) (*jsonlDayIndex, bool, error) {
+	index := newJSONLDayIndex(dataPath, nil)
+	compacted := true
+	for line := range bytes.Lines(data[:bytes.LastIndexByte(data, '\n')+1]) {
+		var entry jsonlIndexEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, false, fmt.Errorf("%w %s: %w", errCorruptDay, dataPath, err)
+		}
+		if !index.add(entry.ID, entry.Type, entry.Timestamp) {
+			compacted = false
+		}
+	}
+	return index, compacted, nil
+}
+
+// appendable returns the events to append to the day, skipping the stored
+// events which preferredEvent would keep.
+func (self *jsonlDayIndex) appendable(events []*event.Event) []*event.Event {
+	var appended []*event.Event
+	for _, evt := range events {
+		if storedType, ok := self.types[evt.ID]; ok {
+			stored := &event.Event{ID: evt.ID, Type: event.Type{Type: storedType}}
+			if preferredEvent(stored, evt) == stored {
+				continue
+			}
+		}
+		appended = append(appended, evt)
+	}
+	return appended
+}
+
+// jsonlStorage is the file storage writing the days as JSONL files
+// (yyyy-mm-dd.jsonl, an event per line) ordered by timestamp. New events are
+// appended to the day, using an index of the event IDs of the day to skip the
+// stored ones. Events older than the stored ones and newer versions of stored
+// events are appended too, and the days they were appended to are compacted
+// (rewritten in order, with the events unique by ID) once, when the backup of
+// the room is finished. Days left uncompacted by an interrupted run are found
+// when the room is finished the first time. Days which still have files of
+// the JSON format are compacted right away. The indexes of the recently
+// appended days are kept in memory.
+type jsonlStorage struct {
+	*fileStorage
+
+	lock       sync.Mutex
+	indexes    map[string]*list.Element       // Elements of indexOrder by path
+	indexOrder *list.List                     // Indexes of the day files appended to, most recently used first
+	unsorted   map[string]map[string]struct{} // Days to compact by room
+	scanned    map[string]bool                // Rooms whose days were checked for uncompacted ones
+}
+
+func newJSONLStorage(files *fileStorage) *jsonlStorage {
+	return &jsonlStorage{
+		fileStorage: files,
+		indexes:     make(map[string]*list.Element),
+		indexOrder:  list.New(),
+		unsorted:    make(map[string]map[string]struct{}),
+		scanned:     make(map[string]bool),
+	}
+}
+
+func (self *jsonlStorage) dayPath(room, day string) string {
+	return filepath.Join(self.roomPath(room), day+jsonlExtension)
+}
+
+// cachedIndex returns the index of the day file in memory, if any.
+func (self *jsonlStorage) cachedIndex(dataPath string) *jsonlDayIndex {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	element, ok := self.indexes[dataPath]
+	if !ok {
+		return nil
+	}
+	self.indexOrder.MoveToFront(element)
+	return element.Value.(*jsonlDayIndex)
+}
+
+// setIndex keeps the index of the day file in memory, evicting the least
+// recently used index if there are too many, or forgets the index of the day
+// file if index is nil.
+func (self *jsonlStorage) setIndex(dataPath string, index *jsonlDayIndex) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if element, ok := self.indexes[dataPath]; ok {
+		self.indexOrder.Remove(element)
+		delete(self.indexes, dataPath)
+	}
+	if index == nil {
+		return
+	}
+	self.indexes[dataPath] = self.indexOrder.PushFront(index)
+	if self.indexOrder.Len() > jsonlIndexCacheSize {
+		oldest := self.indexOrder.Back()
+		self.indexOrder.Remove(oldest)
+		delete(self.indexes, oldest.Value.(*jsonlDayIndex).path)
+	}
+}
+
+// setUnsorted records whether the day needs to be compacted.
+func (self *jsonlStorage) setUnsorted(room, day string, unsorted bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !unsorted {
+		delete(self.unsorted[room], day)
+		return
+	}
+	if self.unsorted[room] == nil {
+		self.unsorted[room] = make(map[string]struct{})
+	}
+	self.unsorted[room][day] = struct{}{}
+}
+
+// dayIndex returns the index of the JSONL file of the day, or nil if the day
+// must be compacted before events can be appended to it.
+func (self *jsonlStorage) dayIndex(room, day string) (*jsonlDayIndex, error) {
+	dataPath := self.dayPath(room, day)
+	if index := self.cachedIndex(dataPath); index != nil {
+		return index, nil
+	}
+
+	paths := self.existingDayPaths(room, day)
+	if len(paths) == 0 {
+		index := newJSONLDayIndex(dataPath, nil)
+		self.setIndex(dataPath, index)
+		return index, nil
+	}
+	if len(paths) > 1 || paths[0] != dataPath {
+		return nil, nil
+	}
+	data, err := readLinesForAppend(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data file %s: %w", dataPath, err)
+	}
+	index, compacted, err := indexJSONLDay(dataPath, data)
+	if err != nil {
+		return nil, nil // Corrupted, quarantined by the compaction
+	}
+	if !compacted {
+		// Left by an interrupted run
+		self.setUnsorted(room, day, true)
+	}
+	self.setIndex(dataPath, index)
+	return index, nil
+}
+
+// appendEvents appends the events to the JSONL file of the day. Returns
+// whether the file is still compacted.
+func (self *jsonlStorage) appendEvents(room, day string, index *jsonlDayIndex, events []*event.Event) (bool, error) {
+	if len(events) == 0 {
+		return true, nil
+	}
+	data, err := marshalJSONLEvents(events)
+	if err != nil {
+		return false, err
+	}
+	if err := self.createRoomDir(room); err != nil {
+		return false, err
+	}
+	dataPath := self.dayPath(room, day)
+	file, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open data file %s: %w", dataPath, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		// The index does not know what was written
+		self.setIndex(dataPath, nil)
+		return false, fmt.Errorf("failed to append to data file %s: %w", dataPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		return false, fmt.Errorf("failed to sync data file %s: %w", dataPath, err)
+	}
+	compacted := true
+	for _, evt := range events {
+		if !index.add(evt.ID, evt.Type.Type, evt.Timestamp) {
+			compacted = false
+		}
+	}
+	return compacted, nil
+}
+
+func (self *jsonlStorage) WriteDay(_ context.Context, room, day string, events []*event.Event) error {
+	dataPath := self.dayPath(room, day)
+	if err := self.createRoomDir(room); err != nil {
+		return err
+	}
+	data, err := marshalJSONLEvents(events)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dataPath, data, 0o644); err != nil {
+		self.setIndex(dataPath, nil)
+		return fmt.Errorf("failed to write data file %s: %w", dataPath, err)
+	}
+	self.setIndex(dataPath, newJSONLDayIndex(dataPath, events))
+	self.setUnsorted(room, day, false)
+	// The files of the day in the JSON format are merged in now
+	var otherPaths []string
+	for _, path := range self.existingDayPaths(room, day) {
+		if path != dataPath {
+			otherPaths = append(otherPaths, path)
+		}
+	}
+	return removeFiles(otherPaths)
+}
+
+// forgetRoom drops the indexes and the days to compact of the room.
+func (self *jsonlStorage) forgetRoom(room string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for dataPath, element := range self.indexes {
+		if filepath.Dir(dataPath) == self.roomPath(room) {
+			self.indexOrder.Remove(element)
+			delete(self.indexes, dataPath)
+		}
+	}
+	delete(self.unsorted, room)
+}
+
+func (self *jsonlStorage) RemoveRoom(ctx context.Context, room string) error {
+	self.forgetRoom(room)
+	self.lock.Lock()
+	delete(self.scanned, room)
+	self.lock.Unlock()
+	return self.fileStorage.RemoveRoom(ctx, room)
+}
+
+func (self *jsonlStorage) QuarantineDay(ctx context.Context, room, day string) (string, error) {
+	self.setIndex(self.dayPath(room, day), nil)
+	self.setUnsorted(room, day, false)
+	return self.fileStorage.QuarantineDay(ctx, room, day)
+}
+
+// StoreEvents appends the new events to the days, compacting the days which
+// still have files of the JSON format, and then replaces the metadata file.
+func (self *jsonlStorage) StoreEvents(ctx context.Context, room string, events []*event.Event, meta *Metadata) error {
+	for day, dailyEvents := range groupEventsByDay(events) {
+		// Unique and in order, as the events within a chunk may be in any order
+		dailyEvents = mergeDayEvents(nil, dailyEvents)
+		index, err := self.dayIndex(room, day)
+		if err != nil {
+			return err
+		}
+		if index != nil {
+			compacted, err := self.appendEvents(room, day, index, index.appendable(dailyEvents))
+			if err != nil {
+				return err
+			}
+			if !compacted {
+				self.setUnsorted(room, day, true)
+			}
+			continue
+		}
+
+		existingEvents, err := readDayOrQuarantine(ctx, self, room, day)
+		if err != nil {
+			return err
+		}
+		if err := self.WriteDay(ctx, room, day, mergeDayEvents(existingEvents, dailyEvents)); err != nil {
+			return err
+		}
+	}
+	if meta == nil {
+		return nil
+	}
+	return self.WriteMetadata(ctx, room, meta)
+}
+
+// scanUnsorted finds the days of the room which are not compacted, unless
+// they were already checked by this run. Such days are left by interrupted
+// runs, and are not noticed otherwise unless events are appended to them.
+func (self *jsonlStorage) scanUnsorted(ctx context.Context, room string) error {
+	self.lock.Lock()
+	scanned := self.scanned[room]
+	self.lock.Unlock()
+	if scanned {
+		return nil
+	}
+	days, err := self.ListDays(ctx, room)
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		dataPath := self.dayPath(room, day)
+		if paths := self.existingDayPaths(room, day); len(paths) != 1 || paths[0] != dataPath {
+			continue // Compacted when appended to
+		}
+		data, err := os.ReadFile(dataPath)
+		if err != nil {
+			return fmt.Errorf("failed to read data file %s: %w", dataPath, err)
+		}
+		if _, compacted, err := indexJSONLDay(dataPath, data); err != nil || !compacted {
+			// Corrupted days are quarantined by the compaction
+			self.setUnsorted(room, day, true)
+		}
+	}
+	self.lock.Lock()
+	self.scanned[room] = true
+	self.lock.Unlock()
+	return nil
+}
+
+// FinishRoom compacts the days of the room which events were appended to out
+// of order, or which were left uncompacted, and drops the indexes of the room.
+func (self *jsonlStorage) FinishRoom(ctx context.Context, room string) error {
+	if err := self.scanUnsorted(ctx, room); err != nil {
+		return err
+	}
+	self.lock.Lock()
+	days := slices.Sorted(maps.Keys(self.unsorted[room]))
+	self.lock.Unlock()
+	for _, day := range days {
+		events, err := readDayOrQuarantine(ctx, self, room, day)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			continue // Quarantined
+		}
+		if err := self.WriteDay(ctx, room, day, events); err != nil {
+			return err
+		}
+	}
+	self.forgetRoom(room)
+	return nil
+}
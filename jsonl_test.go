@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// readJSONLEventIDs returns the event IDs of the lines of a JSONL day file.
+func readJSONLEventIDs(t *testing.T, dataPath string) []id.EventID {
+	t.Helper()
+	data, err := os.ReadFile(dataPath)
+	assert.NilError(t, err)
+	var eventIDs []id.EventID
+	for line := range bytes.Lines(data) {
+		evt, err := parseJSONLEvents(dataPath, line)
+		assert.NilError(t, err)
+		eventIDs = append(eventIDs, evt[0].ID)
+	}
+	return eventIDs
+}
+
+func TestJSONLStorage(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	roomDirName := "Room:" + testRoomID.String()
+	roomPath := filepath.Join(backupDir, roomDirName)
+	dataPath := filepath.Join(roomPath, "2024-01-15.jsonl")
+	day := testBackfillDay.UnixMilli()
+	store := newJSONLStorage(newFileStorage(backupDir))
+
+	// New events are appended, skipping the stored ones
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "b"), newTestEvent("$a", day, "a")}))
+	encrypted := newTestEvent("$b", day+1, "encrypted")
+	encrypted.Type = event.EventEncrypted
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{encrypted, newTestEvent("$c", day+4, "c")}))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$a", "$b", "$c"})
+
+	// An interrupted append is dropped before appending again
+	file, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.NilError(t, err)
+	_, err = file.WriteString(`{"event_id":"$partial"`)
+	assert.NilError(t, err)
+	assert.NilError(t, file.Close())
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 3)
+	store = newJSONLStorage(newFileStorage(backupDir))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$d", day+5, "d")}))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$a", "$b", "$c", "$d"})
+
+	// Older events and new versions of stored events are appended too, and
+	// the day is compacted when the room is finished
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$between", day+2, "between"), newTestEvent("$a", day, "edited")}))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$a", "$b", "$c", "$d", "$a", "$between"})
+	events, err = store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 5)
+	assert.Equal(t, events[0].Content.Raw["body"], "edited")
+	assert.NilError(t, finishRoom(ctx, store, roomDirName))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$a", "$b", "$between", "$c", "$d"})
+	events, err = store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, events[0].Content.Raw["body"], "edited")
+	assert.Equal(t, events[1].Type, event.EventMessage)
+	assert.Equal(t, len(store.indexes), 0)
+
+	// A day left uncompacted by an interrupted run is compacted by the next one
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$early", day+3, "early")}))
+	store = newJSONLStorage(newFileStorage(backupDir))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$e", day+6, "e")}))
+	assert.NilError(t, finishRoom(ctx, store, roomDirName))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$a", "$b", "$between", "$early", "$c", "$d", "$e"})
+
+	// Days in the JSON format are compacted into the JSONL format
+	assert.NilError(t, processEvents(ctx, newFileStorage(backupDir), roomDirName, []*event.Event{newTestEvent("$e", day+86400000, "e")}))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$f", day+86400001, "f")}))
+	assert.Assert(t, !fileExists(filepath.Join(roomPath, "2024-01-16.json")))
+	assert.DeepEqual(t, readJSONLEventIDs(t, filepath.Join(roomPath, "2024-01-16.jsonl")), []id.EventID{"$e", "$f"})
+
+	// The JSON format storage reads the JSONL days too
+	days, err := newFileStorage(backupDir).ListDays(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, days, []string{"2024-01-15", "2024-01-16"})
+	events, err = newFileStorage(backupDir).ReadDay(ctx, roomDirName, "2024-01-16")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+}
+
+func TestJSONLStorageIndexCache(t *testing.T) {
+	ctx := context.Background()
+	store := newJSONLStorage(newFileStorage(t.TempDir()))
+	roomDirName := "Room:" + testRoomID.String()
+	day := testBackfillDay.UnixMilli()
+
+	// Only the indexes of the recently written days are kept
+	for i := range jsonlIndexCacheSize + 2 {
+		assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent(fmt.Sprintf("$%d", i), day+int64(i)*86400000, "a")}))
+	}
+	assert.Equal(t, len(store.indexes), jsonlIndexCacheSize)
+	assert.Equal(t, store.indexOrder.Len(), jsonlIndexCacheSize)
+	assert.Assert(t, store.cachedIndex(store.dayPath(roomDirName, "2024-01-15")) == nil)
+
+	// An evicted day is read again for appending, and the refetched event
+	// is compacted away when the room is finished
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$0", day, "a"), newTestEvent("$new", day+1, "new")}))
+	assert.Equal(t, len(store.unsorted[roomDirName]), 1)
+	assert.NilError(t, finishRoom(ctx, store, roomDirName))
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, len(store.indexes), 0)
+}
+
+func TestJSONLStorageUncompactedDays(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	roomDirName := "Room:" + testRoomID.String()
+	dataPath := filepath.Join(backupDir, roomDirName, "2024-01-14.jsonl")
+	day := testBackfillDay.UnixMilli()
+
+	// An interrupted run leaves a day uncompacted
+	store := newJSONLStorage(newFileStorage(backupDir))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$y", day-86400000+1, "y")}))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$x", day-86400000, "x")}))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$y", "$x"})
+
+	// The next run compacts it, although no events are appended to it
+	store = newJSONLStorage(newFileStorage(backupDir))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$a", day, "a")}))
+	assert.NilError(t, finishRoom(ctx, store, roomDirName))
+	assert.DeepEqual(t, readJSONLEventIDs(t, dataPath), []id.EventID{"$x", "$y"})
+	assert.Assert(t, store.scanned[roomDirName])
+}
+
+func TestConvertBackupJSONL(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	roomDirName := "Room:" + testRoomID.String()
+	roomPath := filepath.Join(backupDir, roomDirName)
+	day := testBackfillDay.UnixMilli()
+	assert.NilError(t, processEvents(ctx, newFileStorage(backupDir), roomDirName, []*event.Event{newTestEvent("$b", day+1, "b"), newTestEvent("$a", day, "a")}))
+
+	assert.ErrorContains(t, convertBackup(ctx, &CLI{BackupDir: backupDir, DayFormat: dayFormatJSONL, Compress: compressZstd}, zerolog.Nop()), "cannot be compressed")
+	assert.NilError(t, convertBackup(ctx, &CLI{BackupDir: backupDir, DayFormat: dayFormatJSONL, Compress: compressNone}, zerolog.Nop()))
+	assert.Assert(t, !fileExists(filepath.Join(roomPath, "2024-01-15.json")))
+	assert.DeepEqual(t, readJSONLEventIDs(t, filepath.Join(roomPath, "2024-01-15.jsonl")), []id.EventID{"$a", "$b"})
+}
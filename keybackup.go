@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// keyBackupETagSecret stores the ETag of the key backup downloaded last, next
+// to the backup key in the crypto store.
+const keyBackupETagSecret id.Secret = "fi.iki.fingon.matrixbackup.key_backup_etag"
+
+var (
+	errKeyBackupAlgorithm = errors.New("unsupported key backup algorithm")
+	errKeyBackupMismatch  = errors.New("key backup public key does not match the backup key")
+)
+
+// keyBackupData is the content of the server-side key backup.
+type keyBackupData = mautrix.RespRoomKeys[backup.EncryptedSessionData[backup.MegolmSessionData]]
+
+// decodeBackupKey decodes the base64 megolm backup private key stored in the crypto store.
+func decodeBackupKey(encoded string) (*backup.MegolmBackupKey, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode megolm backup key: %w", err)
+	}
+	return backup.MegolmBackupKeyFromBytes(raw)
+}
+
+// backupPublicKey returns the public key of the backup key in the form used in the backup auth data.
+func backupPublicKey(key *backup.MegolmBackupKey) id.Ed25519 {
+	return id.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes()))
+}
+
+// fetchBackupKey gets the megolm backup key from secret storage using the
+// recovery key or passphrase. Accounts without secret storage may use the
+// recovery key of the key backup itself.
+func fetchBackupKey(ctx context.Context, client *mautrix.Client, secret string, logger zerolog.Logger) (*backup.MegolmBackupKey, error) {
+	secret = strings.TrimSpace(secret)
+	ssssMachine := ssss.NewSSSSMachine(client)
+	keyID, keyData, err := ssssMachine.GetDefaultKeyData(ctx)
+	if errors.Is(err, ssss.ErrNoDefaultKeyID) {
+		logger.Info().Msg("No secret storage found, using recovery key as key backup key")
+		raw := utils.DecodeBase58RecoveryKey(secret)
+		if raw == nil {
+			return nil, ssss.ErrInvalidRecoveryKey
+		}
+		return backup.MegolmBackupKeyFromBytes(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret storage key: %w", err)
+	}
+
+	key, err := keyData.VerifyRecoveryKey(keyID, secret)
+	if errors.Is(err, ssss.ErrInvalidRecoveryKey) && keyData.Passphrase != nil {
+		logger.Debug().Msg("Not a recovery key, trying it as a passphrase")
+		key, err = keyData.VerifyPassphrase(keyID, secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock secret storage: %w", err)
+	}
+
+	// The secret is base64 encoded, but that is already undone by the decryption
+	raw, err := ssssMachine.GetDecryptedAccountData(ctx, event.AccountDataMegolmBackupKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get megolm backup key from secret storage: %w", err)
+	}
+	return backup.MegolmBackupKeyFromBytes(raw)
+}
+
+// importKeyBackupData decrypts the sessions of a key backup and adds them to
+// the store, keeping the existing sessions which can decrypt as many
+// messages. Returns the number of new and undecryptable sessions.
+func (self *cryptoMachine) importKeyBackupData(ctx context.Context, version id.KeyBackupVersion, data *keyBackupData, backupKey *backup.MegolmBackupKey, logger zerolog.Logger) (int, int) {
+	imported, failed := 0, 0
+	for roomID, roomBackup := range data.Rooms {
+		for sessionID, sessionBackup := range roomBackup.Sessions {
+			sessionLog := logger.With().Str("room_id", roomID.String()).Str("session_id", sessionID.String()).Logger()
+			sessionData, err := sessionBackup.SessionData.Decrypt(backupKey)
+			if err != nil {
+				sessionLog.Warn().Err(err).Msg("Failed to decrypt session from key backup")
+				failed++
+				continue
+			}
+			if sess, err := olm.InboundGroupSessionImport([]byte(sessionData.SessionKey)); err == nil {
+				existing, err := self.store.GetGroupSession(ctx, roomID, sessionID)
+				if err == nil && existing != nil && existing.Internal.FirstKnownIndex() <= sess.FirstKnownIndex() {
+					continue
+				}
+			}
+			if _, err := self.mach.ImportRoomKeyFromBackup(ctx, version, roomID, sessionID, sessionData); err != nil {
+				sessionLog.Warn().Err(err).Msg("Failed to import session from key backup")
+				failed++
+				continue
+			}
+			imported++
+		}
+	}
+	return imported, failed
+}
+
+// restoreKeyBackup downloads the room keys from the latest server-side key
+// backup, if we have the backup key. Unchanged backups are not downloaded again.
+func (self *cryptoMachine) restoreKeyBackup(ctx context.Context) error {
+	encodedKey, err := self.store.GetSecret(ctx, id.SecretMegolmBackupV1)
+	if err != nil {
+		return fmt.Errorf("failed to read key backup key: %w", err)
+	}
+	if encodedKey == "" {
+		return nil
+	}
+	backupKey, err := decodeBackupKey(encodedKey)
+	if err != nil {
+		return err
+	}
+	knownETag, err := self.store.GetSecret(ctx, keyBackupETagSecret)
+	if err != nil {
+		return fmt.Errorf("failed to read key backup ETag: %w", err)
+	}
+
+	versionInfo, err := self.client.GetKeyBackupLatestVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get key backup version: %w", err)
+	}
+	backupLog := self.log.With().Str("key_backup_version", versionInfo.Version.String()).Int("count", versionInfo.Count).Logger()
+	if versionInfo.Algorithm != id.KeyBackupAlgorithmMegolmBackupV1 {
+		return fmt.Errorf("%w: %s", errKeyBackupAlgorithm, versionInfo.Algorithm)
+	}
+	if versionInfo.AuthData.PublicKey != backupPublicKey(backupKey) {
+		return errKeyBackupMismatch
+	}
+	if versionInfo.Version == self.mach.KeyBackupVersion() && versionInfo.ETag != "" && versionInfo.ETag == knownETag {
+		backupLog.Debug().Msg("Key backup unchanged since last run")
+		return nil
+	}
+
+	backupLog.Info().Msg("Downloading room keys from key backup...")
+	data, err := self.client.GetKeyBackup(ctx, versionInfo.Version)
+	if err != nil {
+		return fmt.Errorf("failed to download key backup: %w", err)
+	}
+	imported, failed := self.importKeyBackupData(ctx, versionInfo.Version, data, backupKey, backupLog)
+	backupLog.Info().Int("imported", imported).Int("failed", failed).Msg("Restored room keys from key backup")
+
+	if err := self.mach.SetKeyBackupVersion(ctx, versionInfo.Version); err != nil {
+		return fmt.Errorf("failed to store key backup version: %w", err)
+	}
+	if err := self.store.PutSecret(ctx, keyBackupETagSecret, versionInfo.ETag); err != nil {
+		return fmt.Errorf("failed to store key backup ETag: %w", err)
+	}
+	return nil
+}
+
+// unlockKeyBackup fetches the backup key using the recovery key or
+// passphrase and remembers it in the crypto store for later runs.
+func unlockKeyBackup(ctx context.Context, machine *cryptoMachine, cli *CLI, logger zerolog.Logger) error {
+	secret, err := readSecret(cli.RecoveryKeyFile, "Recovery key or passphrase: ", "--recovery-key-file")
+	if err != nil {
+		return err
+	}
+	backupKey, err := fetchBackupKey(ctx, machine.client, secret, logger)
+	if err != nil {
+		return err
+	}
+	if err := machine.store.PutSecret(ctx, id.SecretMegolmBackupV1, base64.RawStdEncoding.EncodeToString(backupKey.Bytes())); err != nil {
+		return fmt.Errorf("failed to store key backup key: %w", err)
+	}
+	// Force a download even if the backup did not change
+	if err := machine.store.DeleteSecret(ctx, keyBackupETagSecret); err != nil {
+		return fmt.Errorf("failed to reset key backup ETag: %w", err)
+	}
+	logger.Info().Str("public_key", backupPublicKey(backupKey).String()).Msg("Unlocked server-side key backup")
+	return nil
+}
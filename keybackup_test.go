@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/goolm/session"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testAccountDataPath = "/_matrix/client/v3/user/@user:example.org/account_data/"
+	testKeyBackupPath   = "/_matrix/client/v3/room_keys/keys"
+	testKeyBackupETag   = "etag1"
+	testBackupPassword  = "backup passphrase"
+)
+
+// newTestKeyBackup creates the key backup responses containing the given outbound session.
+func newTestKeyBackup(t *testing.T, backupKey *backup.MegolmBackupKey, outbound *session.MegolmOutboundSession) map[string]any {
+	t.Helper()
+	sessionData, err := backup.EncryptSessionData(backupKey, backup.MegolmSessionData{
+		Algorithm:         id.AlgorithmMegolmV1,
+		SenderClaimedKeys: backup.SenderClaimedKeys{Ed25519: testSigningKey},
+		SenderKey:         testSenderKey,
+		SessionKey:        newTestExportedSession(t, outbound).SessionKey,
+	})
+	assert.NilError(t, err)
+	return map[string]any{
+		"/_matrix/client/v3/room_keys/version": mautrix.RespRoomKeysVersion[backup.MegolmAuthData]{
+			Algorithm: id.KeyBackupAlgorithmMegolmBackupV1,
+			AuthData:  backup.MegolmAuthData{PublicKey: backupPublicKey(backupKey)},
+			Count:     1,
+			ETag:      testKeyBackupETag,
+			Version:   "1",
+		},
+		testKeyBackupPath: map[string]any{
+			"rooms": map[id.RoomID]any{
+				testRoomID: map[string]any{
+					"sessions": map[id.SessionID]any{
+						outbound.ID(): map[string]any{"session_data": sessionData},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newTestServerCryptoMachine(t *testing.T, server *httptest.Server) *cryptoMachine {
+	t.Helper()
+	return loadTestCryptoMachine(t, server, "DEVICE", t.TempDir())
+}
+
+func writeTestSecret(t *testing.T, secret string) *CLI {
+	t.Helper()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	assert.NilError(t, os.WriteFile(secretFile, []byte(secret+"\n"), 0o600))
+	return &CLI{RecoveryKeyFile: secretFile}
+}
+
+func TestKeyBackupSecretStorage(t *testing.T) {
+	ctx := context.Background()
+	backupKey, err := backup.NewMegolmBackupKey()
+	assert.NilError(t, err)
+	outbound, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	responses := newTestKeyBackup(t, backupKey, outbound)
+	evt := newTestEncryptedEvent(t, outbound, "$evt1", 1, "backed up")
+
+	ssssKey, err := ssss.NewKey(testBackupPassword)
+	assert.NilError(t, err)
+	responses[testAccountDataPath+event.AccountDataSecretStorageDefaultKey.Type] = ssss.DefaultSecretStorageKeyContent{KeyID: ssssKey.ID}
+	responses[testAccountDataPath+event.AccountDataSecretStorageKey.Type+"."+ssssKey.ID] = ssssKey.Metadata
+	responses[testAccountDataPath+event.AccountDataMegolmBackupKey.Type] = ssss.EncryptedAccountDataEventContent{
+		Encrypted: map[string]ssss.EncryptedKeyData{
+			ssssKey.ID: ssssKey.Encrypt(event.AccountDataMegolmBackupKey.Type, backupKey.Bytes()),
+		},
+	}
+	server, requests := newTestHomeserver(t, responses)
+
+	t.Run("Recovery key", func(t *testing.T) {
+		machine := newTestServerCryptoMachine(t, server)
+		assert.NilError(t, unlockKeyBackup(ctx, machine, writeTestSecret(t, ssssKey.RecoveryKey()), zerolog.Nop()))
+		assert.NilError(t, machine.restoreKeyBackup(ctx))
+		assert.Equal(t, machine.mach.KeyBackupVersion(), id.KeyBackupVersion("1"))
+		decrypted, err := machine.Decrypt(ctx, evt)
+		assert.NilError(t, err)
+		assert.Equal(t, decrypted.Content.Raw["body"], "backed up")
+
+		// Unchanged backup is not downloaded again
+		before := requests.count(testKeyBackupPath)
+		assert.NilError(t, machine.restoreKeyBackup(ctx))
+		assert.Equal(t, requests.count(testKeyBackupPath), before)
+	})
+
+	t.Run("Passphrase", func(t *testing.T) {
+		machine := newTestServerCryptoMachine(t, server)
+		assert.NilError(t, unlockKeyBackup(ctx, machine, writeTestSecret(t, testBackupPassword), zerolog.Nop()))
+		assert.NilError(t, machine.restoreKeyBackup(ctx))
+		_, err := machine.Decrypt(ctx, evt)
+		assert.NilError(t, err)
+	})
+
+	t.Run("Wrong passphrase", func(t *testing.T) {
+		machine := newTestServerCryptoMachine(t, server)
+		err := unlockKeyBackup(ctx, machine, writeTestSecret(t, "wrong"), zerolog.Nop())
+		assert.Assert(t, errors.Is(err, ssss.ErrIncorrectSSSSKey))
+	})
+}
+
+func TestKeyBackupWithoutSecretStorage(t *testing.T) {
+	ctx := context.Background()
+	backupKey, err := backup.NewMegolmBackupKey()
+	assert.NilError(t, err)
+	outbound, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	server, _ := newTestHomeserver(t, newTestKeyBackup(t, backupKey, outbound))
+
+	machine := newTestServerCryptoMachine(t, server)
+	recoveryKey := utils.EncodeBase58RecoveryKey(backupKey.Bytes())
+	assert.NilError(t, unlockKeyBackup(ctx, machine, writeTestSecret(t, recoveryKey), zerolog.Nop()))
+	assert.NilError(t, machine.restoreKeyBackup(ctx))
+	_, err = machine.Decrypt(ctx, newTestEncryptedEvent(t, outbound, "$evt1", 1, "legacy"))
+	assert.NilError(t, err)
+
+	t.Run("Key does not match backup", func(t *testing.T) {
+		otherKey, err := backup.NewMegolmBackupKey()
+		assert.NilError(t, err)
+		machine := newTestServerCryptoMachine(t, server)
+		recoveryKey := utils.EncodeBase58RecoveryKey(otherKey.Bytes())
+		assert.NilError(t, unlockKeyBackup(ctx, machine, writeTestSecret(t, recoveryKey), zerolog.Nop()))
+		err = machine.restoreKeyBackup(ctx)
+		assert.Assert(t, errors.Is(err, errKeyBackupMismatch))
+	})
+}
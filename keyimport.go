@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/term"
+)
+
+// Key export file format as specified in
+// https://spec.matrix.org/v1.14/client-server-api/#key-exports
+const (
+	keyExportPrefix       = "-----BEGIN MEGOLM SESSION DATA-----"
+	keyExportSuffix       = "-----END MEGOLM SESSION DATA-----"
+	keyExportVersion1     = 0x01
+	keyExportHeaderLength = 1 + 16 + 16 + 4 // version + salt + IV + rounds
+	keyExportHashLength   = 32
+
+	// keyExportMaxRounds limits the PBKDF2 rounds given by the file, so that a
+	// crafted file cannot keep the key derivation running for hours. Element
+	// uses 500000 rounds.
+	keyExportMaxRounds = 10_000_000
+)
+
+var (
+	errKeyExportFormat  = errors.New("invalid key export file")
+	errKeyExportVersion = errors.New("unsupported key export format version")
+	errKeyExportRounds  = errors.New("key export has too many PBKDF2 rounds")
+	errNoTerminal       = errors.New("no terminal to prompt for the secret")
+)
+
+// decodeKeyExport strips the armor of a key export file and decodes the base64 payload.
+func decodeKeyExport(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(strings.ReplaceAll(string(data), "\r\n", "\n"))
+	if !strings.HasPrefix(text, keyExportPrefix) || !strings.HasSuffix(text, keyExportSuffix) {
+		return nil, fmt.Errorf("%w: missing header or footer", errKeyExportFormat)
+	}
+	text = strings.TrimSuffix(strings.TrimPrefix(text, keyExportPrefix), keyExportSuffix)
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errKeyExportFormat, err)
+	}
+	if len(decoded) < keyExportHeaderLength+keyExportHashLength {
+		return nil, fmt.Errorf("%w: too short", errKeyExportFormat)
+	}
+	return decoded, nil
+}
+
+// checkKeyExport checks the header of the decoded key export payload.
+func checkKeyExport(exportData []byte) error {
+	if exportData[0] != keyExportVersion1 {
+		return errKeyExportVersion
+	}
+	if rounds := binary.BigEndian.Uint32(exportData[33:37]); rounds > keyExportMaxRounds {
+		return fmt.Errorf("%w: %d (at most %d are accepted)", errKeyExportRounds, rounds, keyExportMaxRounds)
+	}
+	return nil
+}
+
+// importKeyExport imports an Element style key export file into the crypto
+// store. The file is armored again in the exact form the olm machine expects,
+// so that files with e.g. different line lengths or whitespace are accepted.
+func (self *cryptoMachine) importKeyExport(ctx context.Context, data []byte, passphrase string) (int, int, error) {
+	exportData, err := decodeKeyExport(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkKeyExport(exportData); err != nil {
+		return 0, 0, err
+	}
+	armored := keyExportPrefix + "\n" + base64.StdEncoding.EncodeToString(exportData) + "\n" + keyExportSuffix + "\n"
+	return self.mach.ImportKeys(ctx, passphrase, []byte(armored))
+}
+
+// readSecret reads a secret from the given file (if set), or by prompting for
+// it on the terminal. flagName is the option to suggest when there is no terminal.
+func readSecret(secretFile string, prompt string, flagName string) (string, error) {
+	if secretFile != "" {
+		data, err := os.ReadFile(secretFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file %s: %w", secretFile, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("%w, use %s", errNoTerminal, flagName)
+	}
+	if _, err := os.Stderr.WriteString(prompt); err != nil {
+		return "", err
+	}
+	secret, err := term.ReadPassword(fd)
+	_, _ = os.Stderr.WriteString("\n")
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+	return string(bytes.TrimRight(secret, "\r\n")), nil
+}
+
+// importKeyFile imports the key export file given on the command line.
+func importKeyFile(ctx context.Context, machine *cryptoMachine, cli *CLI, logger zerolog.Logger) error {
+	data, err := os.ReadFile(cli.ImportKeys)
+	if err != nil {
+		return fmt.Errorf("failed to read key export file %s: %w", cli.ImportKeys, err)
+	}
+	passphrase, err := readSecret(cli.KeysPassphraseFile, "Key export passphrase: ", "--keys-passphrase-file")
+	if err != nil {
+		return err
+	}
+	imported, total, err := machine.importKeyExport(ctx, data, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to import keys from %s: %w", cli.ImportKeys, err)
+	}
+	logger.Info().Str("path", cli.ImportKeys).Int("imported", imported).Int("total", total).Msg("Imported room keys from key export")
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/goolm/session"
+	"maunium.net/go/mautrix/id"
+)
+
+const testKeyExportRounds = 1000
+
+// newTestKeyExport creates a key export file the same way Element does.
+func newTestKeyExport(t *testing.T, passphrase string, sessions []crypto.ExportedSession) []byte {
+	t.Helper()
+	plaintext, err := json.Marshal(sessions)
+	assert.NilError(t, err)
+
+	salt := make([]byte, 16)
+	iv := make([]byte, 16)
+	_, _ = rand.Read(salt)
+	_, _ = rand.Read(iv)
+	iv[7] &= 0b11111110
+	key, err := pbkdf2.Key(sha512.New, passphrase, salt, testKeyExportRounds, 64)
+	assert.NilError(t, err)
+
+	exportData := make([]byte, keyExportHeaderLength, keyExportHeaderLength+len(plaintext)+keyExportHashLength)
+	exportData[0] = keyExportVersion1
+	copy(exportData[1:17], salt)
+	copy(exportData[17:33], iv)
+	binary.BigEndian.PutUint32(exportData[33:37], testKeyExportRounds)
+	exportData = exportData[:keyExportHeaderLength+len(plaintext)]
+	block, err := aes.NewCipher(key[:32])
+	assert.NilError(t, err)
+	cipher.NewCTR(block, iv).XORKeyStream(exportData[keyExportHeaderLength:], plaintext)
+	mac := hmac.New(sha256.New, key[32:])
+	mac.Write(exportData)
+	exportData = mac.Sum(exportData)
+
+	encoded := base64.StdEncoding.EncodeToString(exportData)
+	result := keyExportPrefix + "\n"
+	for len(encoded) > 76 {
+		result += encoded[:76] + "\n"
+		encoded = encoded[76:]
+	}
+	return []byte(result + encoded + "\n" + keyExportSuffix + "\n")
+}
+
+func newTestExportedSession(t *testing.T, outbound *session.MegolmOutboundSession) crypto.ExportedSession {
+	t.Helper()
+	inbound, err := session.NewMegolmInboundSession([]byte(outbound.Key()))
+	assert.NilError(t, err)
+	exported, err := inbound.Export(inbound.FirstKnownIndex())
+	assert.NilError(t, err)
+	return crypto.ExportedSession{
+		Algorithm:         id.AlgorithmMegolmV1,
+		RoomID:            testRoomID,
+		SenderKey:         testSenderKey,
+		SenderClaimedKeys: crypto.SenderClaimedKeys{Ed25519: testSigningKey},
+		SessionID:         outbound.ID(),
+		SessionKey:        string(exported),
+	}
+}
+
+func TestImportKeyExport(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	machine := newTestCryptoMachine(t, backupDir)
+	outbound, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	exported := newTestExportedSession(t, outbound)
+	unsupported := crypto.ExportedSession{Algorithm: "m.unknown", RoomID: testRoomID}
+	data := newTestKeyExport(t, "passphrase", []crypto.ExportedSession{exported, unsupported})
+
+	t.Run("Wrong passphrase", func(t *testing.T) {
+		_, _, err := machine.importKeyExport(ctx, data, "wrong")
+		assert.Assert(t, errors.Is(err, crypto.ErrMismatchingExportHash))
+	})
+
+	t.Run("Not a key export", func(t *testing.T) {
+		_, _, err := machine.importKeyExport(ctx, []byte("garbage"), "passphrase")
+		assert.Assert(t, errors.Is(err, errKeyExportFormat))
+	})
+
+	t.Run("Too many rounds", func(t *testing.T) {
+		exportData, err := decodeKeyExport(data)
+		assert.NilError(t, err)
+		binary.BigEndian.PutUint32(exportData[33:37], keyExportMaxRounds+1)
+		assert.Assert(t, errors.Is(checkKeyExport(exportData), errKeyExportRounds))
+	})
+
+	t.Run("Import", func(t *testing.T) {
+		// Windows line endings and surrounding whitespace are accepted
+		crlf := bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+		imported, total, err := machine.importKeyExport(ctx, append([]byte("\n  "), crlf...), "passphrase")
+		assert.NilError(t, err)
+		assert.Equal(t, imported, 1)
+		assert.Equal(t, total, 2)
+
+		// Importing the same keys again adds nothing
+		imported, _, err = machine.importKeyExport(ctx, data, "passphrase")
+		assert.NilError(t, err)
+		assert.Equal(t, imported, 0)
+	})
+
+	t.Run("Imported keys are persisted and usable", func(t *testing.T) {
+		loaded := newTestCryptoMachine(t, backupDir)
+		decrypted, err := loaded.Decrypt(ctx, newTestEncryptedEvent(t, outbound, "$evt1", 1, "imported"))
+		assert.NilError(t, err)
+		assert.Equal(t, decrypted.Content.Raw["body"], "imported")
+	})
+}
+
+func TestReadSecret(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	err := os.WriteFile(passphraseFile, []byte("secret passphrase\n"), 0o600)
+	assert.NilError(t, err)
+
+	passphrase, err := readSecret(passphraseFile, "Passphrase: ", "--keys-passphrase-file")
+	assert.NilError(t, err)
+	assert.Equal(t, passphrase, "secret passphrase")
+}
@@ -31,6 +31,8 @@ func setupLogging(cli *CLI) zerolog.Logger {
 
 	// Set the global logger instance used by log.Debug(), log.Info(), etc.
 	log.Logger = logger
+	// Used by zerolog.Ctx() when the context has no logger of a room
+	zerolog.DefaultContextLogger = &log.Logger
 
 	return logger
 }
@@ -2,14 +2,27 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/rs/zerolog/log"
 )
 
+// exitCodeInterrupted is the exit code when the process is stopped with
+// SIGINT or SIGTERM (as with shells, 128 + SIGINT)
+const exitCodeInterrupted = 130
+
 // CLI holds the command-line arguments
 type CLI struct {
+	Backup     struct{} `kong:"cmd,default='1',help='Back up joined rooms (default).'"`
+	Redecrypt  struct{} `kong:"cmd,help='Decrypt previously stored encrypted events with the current room keys.'"`
+	VerifyGaps struct{} `kong:"cmd,name='verify-gaps',help='Find gaps in the stored room timelines and fetch the missing events.'"`
+	Watch      struct{} `kong:"cmd,help='Keep running, archiving new events as they arrive (stop with SIGINT or SIGTERM).'"`
+	Convert    struct{} `kong:"cmd,help='Rewrite the stored day files in the --day-format format with the --compress compression (no connection to the server needed).'"`
+
 	// Credentials can be provided via flags or a config file. Flags take precedence.
 	// Server, User, and Token are required either via flags or config file.
 	Server     string `kong:"name='server',help='Matrix homeserver URL.',group='Credentials'"`
@@ -18,11 +31,40 @@ type CLI struct {
 	DeviceID   string `kong:"name='device',help='Device ID (optional).',group='Credentials'"`
 	ConfigFile string `kong:"name='config',type='path',default='~/.config/matrix-commander/credentials.json',help='Path to a JSON file containing credentials (server, user, token, device_id). Default: ~/.config/matrix-commander/credentials.json',group='Credentials'"`
 
-	FetchDelay       time.Duration `default:"10ms" help:"Delay between requests"`
-	MaxWhoamiRetries int           `kong:"name='max-whoami-retries',default='0',help='Maximum number of retries for the initial Whoami check (0 for infinite).',group='Options'"`
+	FetchDelay        time.Duration `default:"10ms" help:"Minimum delay between requests to the server (shared by all parallel workers)"`
+	Parallel          int           `kong:"name='parallel',default='1',help='Number of rooms to back up concurrently.',group='Options'"`
+	MaxRetries        int           `kong:"name='max-retries',default='5',help='Maximum number of retries of a request failing with a temporary network or server error, or a rate limit (0 to disable).',group='Options'"`
+	MaxWhoamiRetries  int           `kong:"name='max-whoami-retries',default='0',help='Maximum number of retries for the initial Whoami check (0 for infinite).',group='Options'"`
+	Media             bool          `kong:"name='media',default='true',negatable,help='Download media (images, files, avatars, ...) referenced by events.',group='Options'"`
+	HistoryOrder      string        `kong:"name='history-order',enum='forward,backward',default='forward',help='Order in which the history of a room is fetched on its first backup (backward writes the recent days first).',group='Options'"`
+	FollowUpgrades    bool          `kong:"name='follow-upgrades',default='true',negatable,help='Also back up the predecessor and successor rooms of upgraded rooms.',group='Options'"`
+	GapThreshold      time.Duration `kong:"name='gap-threshold',default='6h',help='Minimum time between consecutive stored events to check for missing events in verify-gaps.',group='Options'"`
+	Incremental       bool          `kong:"name='incremental',help='Back up only the rooms with new activity since the previous run (using /sync); the first run makes a full backup.',group='Options'"`
+	ReconcileInterval time.Duration `kong:"name='reconcile-interval',default='24h',help='Interval of full backups of all rooms in watch mode.',group='Options'"`
+	IncludeLeft       bool          `kong:"name='include-left',help='Also back up rooms the user has left or been banned from, and rooms the user is invited to.',group='Options'"`
+
+	// End-to-end encryption
+	E2EE               bool   `kong:"name='e2ee',default='true',negatable,help='Decrypt end-to-end encrypted rooms (crypto store is kept in the backup directory).',group='Encryption'"`
+	PickleKeyFile      string `kong:"name='pickle-key-file',type='path',help='File containing the key encrypting the crypto store (default: crypto-pickle.key in the backup directory, created if missing).',group='Encryption'"`
+	ImportKeys         string `kong:"name='import-keys',type='path',help='Import megolm room keys from an Element key export file.',group='Encryption'"`
+	KeyBackup          bool   `kong:"name='key-backup',help='Unlock server-side key backup with the recovery key or passphrase; the backup key is stored for later runs.',group='Encryption'"`
+	RecoveryKeyFile    string `kong:"name='recovery-key-file',type='path',help='File containing the recovery key or passphrase for --key-backup (prompted for if not given).',group='Encryption'"`
+	KeysPassphraseFile string `kong:"name='keys-passphrase-file',type='path',help='File containing the key export passphrase (prompted for if not given).',group='Encryption'"`
+
+	// S3-compatible bucket for --storage s3
+	S3Endpoint  string `kong:"name='s3-endpoint',help='Endpoint (host:port) of the S3-compatible service.',group='S3'"`
+	S3Bucket    string `kong:"name='s3-bucket',help='Bucket to store the backup in.',group='S3'"`
+	S3Prefix    string `kong:"name='s3-prefix',help='Prefix of the object keys in the bucket (e.g. matrix/).',group='S3'"`
+	S3Region    string `kong:"name='s3-region',default='us-east-1',help='Region of the bucket.',group='S3'"`
+	S3AccessKey string `kong:"name='s3-access-key',env='S3_ACCESS_KEY',help='Access key.',group='S3'"`
+	S3SecretKey string `kong:"name='s3-secret-key',env='S3_SECRET_KEY',help='Secret key.',group='S3'"`
+	S3Insecure  bool   `kong:"name='s3-insecure',help='Use plain HTTP instead of HTTPS (e.g. for a local MinIO).',group='S3'"`
 
 	// Other options
 	BackupDir string `kong:"name='dir',default='./backup',help='Directory to store backups.',group='Options'"`
+	DayFormat string `kong:"name='day-format',enum='json,jsonl',default='json',help='Format of the day files written: json (yyyy-mm-dd.json, an array of events) or jsonl (yyyy-mm-dd.jsonl, an event per line, with new events appended); files are read in either format.',group='Options'"`
+	Compress  string `kong:"name='compress',enum='none,gzip,zstd',default='none',help='Compression of the day files written (yyyy-mm-dd.json.gz or .json.zst); files are read with any compression.',group='Options'"`
+	Storage   string `kong:"name='storage',enum='file,sqlite,s3',default='file',help='Storage of the events, room metadata and other room files: file (a JSON file per day), sqlite (backup.sqlite in the backup directory) or s3 (a bucket, with also the media and the sync position; only the crypto store stays in the backup directory).',group='Options'"`
 	Debug     bool   `kong:"name='debug',help='Enable debug logging.'"`
 	LogJSON   bool   `kong:"name='log-json',help='Output logs in JSON format.'"`
 	Color     bool   `kong:"name='log-color',help='Color logs.'"`
@@ -34,6 +76,34 @@ func main() {
 
 	logger := setupLogging(&cli)
 
+	// Interrupting stops the backup after the chunks in progress, saving the tokens
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals) // A second signal terminates the process
+		logger.Warn().Str("signal", sig.String()).Msg("Interrupted, stopping after the current chunks (interrupt again to exit immediately)")
+		cancel()
+	}()
+	exitIfInterrupted := func() {
+		if ctx.Err() != nil {
+			logger.Warn().Msg("Interrupted, progress up to the last stored chunk has been saved")
+			kctx.Exit(exitCodeInterrupted)
+		}
+	}
+
+	if kctx.Command() == "convert" {
+		// Converting the stored files needs no credentials nor a connection to the server
+		if err := convertBackup(ctx, &cli, logger); err != nil {
+			exitIfInterrupted()
+			logger.Error().Err(err).Msg("Conversion finished with errors.")
+			kctx.Exit(1)
+		}
+		return
+	}
+
 	// Load and validate configuration
 	if err := loadAndValidateConfig(&cli, logger); err != nil {
 		// Use the global logger from zerolog/log for fatal errors before full setup might be complete
@@ -50,18 +120,56 @@ func main() {
 	logEvent.Msg("Configuration")
 
 	// Initialize Matrix client
-	client, err := initializeMatrixClient(&cli, logger)
+	client, closeCrypto, err := initializeMatrixClient(ctx, &cli, logger)
 	if err != nil {
+		exitIfInterrupted()
 		// Error already logged in initializeMatrixClient
 		logger.Fatal().Msg("Initialization failed") // Use Fatal to exit
 		kctx.Exit(1)                                // For consistency
 	}
+	defer func() {
+		if err := closeCrypto(); err != nil {
+			logger.Warn().Err(err).Msg("Failed to close crypto store")
+		}
+	}()
+
+	if kctx.Command() == "redecrypt" {
+		if err := redecryptBackup(ctx, client, &cli, logger); err != nil {
+			exitIfInterrupted()
+			logger.Error().Err(err).Msg("Re-decryption finished with errors.")
+			kctx.Exit(1)
+		}
+		return
+	}
+
+	if kctx.Command() == "verify-gaps" {
+		if err := verifyGaps(ctx, client, &cli, logger); err != nil {
+			exitIfInterrupted()
+			logger.Error().Err(err).Msg("Gap verification finished with errors.")
+			kctx.Exit(1)
+		}
+		return
+	}
+
+	if kctx.Command() == "watch" {
+		// Watch mode is meant to be stopped with a signal, so it is not an error
+		if err := watchRooms(ctx, client, &cli, logger); err != nil {
+			logger.Error().Err(err).Msg("Watching finished with errors.")
+			kctx.Exit(1)
+		}
+		return
+	}
 
 	// Backup joined rooms
-	err = backupJoinedRooms(context.Background(), client, &cli, logger)
+	if cli.Incremental {
+		err = backupIncremental(ctx, client, &cli, logger)
+	} else {
+		err = backupRooms(ctx, client, &cli, logger)
+	}
+	exitIfInterrupted()
 	if err != nil {
-		// Specific errors logged within backupJoinedRooms
-		logger.Error().Msg("Matrix backup process finished with errors.")
+		// Specific errors logged within backupRooms
+		logger.Error().Err(err).Msg("Matrix backup process finished with errors.")
 		kctx.Exit(1)
 	}
 	logger.Info().Msg("Matrix backup process finished successfully.")
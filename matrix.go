@@ -5,13 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net"
-	"net/url"
+	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -54,17 +51,107 @@ func getRoomName(ctx context.Context, logger zerolog.Logger, client *mautrix.Cli
 	return string(roomID), nil
 }
 
+// processMessageChunk decrypts the fetched events, downloads their media
+// unless media is nil, and then stores them together with the metadata, unless
+// it is nil. The tokens of the metadata are thus saved only once the chunk is
+// fully stored.
+func processMessageChunk(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, chunk []*event.Event, meta *Metadata, roomLog zerolog.Logger, media *mediaStore) error {
+	if client.Crypto != nil {
+		if failed := decryptEvents(ctx, client.Crypto, roomID, chunk, roomLog); failed > 0 {
+			roomLog.Warn().Int("count", failed).Msg("Some encrypted events could not be decrypted")
+		}
+	}
+
+	if media != nil {
+		if err := downloadEventMedia(ctx, client, media, roomDirName, chunk, roomLog); err != nil {
+			roomLog.Error().Err(err).Msg("Failed to download media of message chunk")
+			return err
+		}
+	}
+
+	if err := store.StoreEvents(ctx, roomDirName, chunk, meta); err != nil {
+		roomLog.Error().Err(err).Msg("Failed to store message chunk")
+		return err
+	}
+	return nil
+}
+
+// isInvalidTokenError checks whether the server rejected the pagination token.
+func isInvalidTokenError(err error) bool {
+	if errors.Is(err, mautrix.MInvalidParam) {
+		return true
+	}
+	// Some servers report unknown tokens as M_UNKNOWN
+	var httpErr mautrix.HTTPError
+	return errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.Response != nil &&
+		httpErr.Response.StatusCode == http.StatusBadRequest && httpErr.RespError.ErrCode == mautrix.MUnknown.ErrCode &&
+		strings.Contains(strings.ToLower(httpErr.RespError.Err), "token")
+}
+
+// handleInvalidToken finds a new pagination token after the server rejected
+// the stored one, using /context on the newest stored event when paginating
+// forwards (or the oldest one when paginating backwards). The events between
+// the stored event and the new token are processed too, so nothing is lost.
+// Without stored events, pagination restarts from the start (or the end) of
+// the timeline. The new token is stored in the metadata together with the
+// events. Returns the new token and the number of processed events.
+func handleInvalidToken(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, direction mautrix.Direction, meta *Metadata, roomLog zerolog.Logger, media *mediaStore) (string, int, error) {
+	anchor, err := storedEdgeEvent(ctx, store, roomDirName, direction == mautrix.DirectionForward)
+	if err != nil {
+		return "", 0, err
+	}
+	if anchor == nil {
+		roomLog.Warn().Msg("Pagination token rejected and no stored events, restarting pagination")
+		return "", 0, nil
+	}
+
+	resp, err := client.Context(ctx, roomID, anchor.ID, nil, gapContextLimit)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to re-anchor pagination at %s: %w", anchor.ID, err)
+	}
+	token, events := resp.End, resp.EventsAfter
+	if direction == mautrix.DirectionBackward {
+		token, events = resp.Start, resp.EventsBefore
+		meta.BackfillToken = token
+	} else {
+		meta.NextToken = token
+	}
+	if err := processMessageChunk(ctx, client, roomID, store, roomDirName, events, meta, roomLog, media); err != nil {
+		return "", 0, err
+	}
+	roomLog.Warn().Str("event_id", anchor.ID.String()).Str("token", token).Msg("Pagination token rejected, re-anchored at stored event")
+	return token, len(events), nil
+}
+
 // fetchAndProcessRoomMessages contains the main loop for fetching messages and processing them.
-func fetchAndProcessRoomMessages(ctx context.Context, client *mautrix.Client, roomID id.RoomID, roomPath, initialToken string, roomLog zerolog.Logger, cli *CLI) (string, int, error) {
-	currentToken := initialToken
+// Media of the events is downloaded to the media store, unless it is nil.
+// The next token of the metadata is saved with each processed chunk, so an
+// interrupted run resumes from the last stored chunk. Returns the number of
+// fetched events.
+func fetchAndProcessRoomMessages(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, meta *Metadata, roomLog zerolog.Logger, media *mediaStore) (int, error) {
+	currentToken := meta.NextToken
 	fetchDirection := mautrix.DirectionForward
 	totalFetched := 0
+	reanchored := false
 	for {
 		roomLog.Debug().Str("direction", string(fetchDirection)).Str("token", currentToken).Int("limit", fetchLimit).Msg("Fetching messages")
 		resp, err := client.Messages(ctx, roomID, currentToken, "", fetchDirection, nil, fetchLimit)
+		if err != nil && currentToken != "" && !reanchored && isInvalidTokenError(err) {
+			reanchored = true
+			var newToken string
+			var fetched int
+			newToken, fetched, err = handleInvalidToken(ctx, client, roomID, store, roomDirName, fetchDirection, meta, roomLog, media)
+			totalFetched += fetched
+			if err == nil {
+				currentToken = newToken
+				continue
+			}
+		}
 		if err != nil {
-			roomLog.Error().Err(err).Msg("Failed to fetch messages")
-			return currentToken, totalFetched, err
+			if ctx.Err() == nil {
+				roomLog.Error().Err(err).Msg("Failed to fetch messages")
+			}
+			return totalFetched, err
 		}
 
 		if len(resp.Chunk) == 0 {
@@ -74,34 +161,65 @@ func fetchAndProcessRoomMessages(ctx context.Context, client *mautrix.Client, ro
 
 		roomLog.Debug().Int("count", len(resp.Chunk)).Str("start_token", resp.Start).Str("end_token", resp.End).Msg("Fetched message chunk")
 
-		if err := processEvents(roomPath, resp.Chunk); err != nil {
-			roomLog.Error().Err(err).Msg("Failed to process message chunk")
-			return currentToken, totalFetched, err
+		nextToken := resp.End
+		meta.NextToken = nextToken
+		if err := processMessageChunk(ctx, client, roomID, store, roomDirName, resp.Chunk, meta, roomLog, media); err != nil {
+			return totalFetched, err
 		}
 		totalFetched += len(resp.Chunk)
 
-		nextToken := resp.End
-
 		if currentToken == nextToken {
 			roomLog.Debug().Msg("Reached end of history (token did not change)")
 			break
 		}
 		currentToken = nextToken
+	}
+	return totalFetched, nil
+}
+
+// backupRoomMessages fetches the messages of the room since the previous run.
+// On the first backup of the room the history is backfilled backwards from the
+// present first (if enabled), and an interrupted backfill is resumed after the
+// new messages have been fetched. Returns the number of fetched events.
+func backupRoomMessages(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, meta *Metadata, roomLog zerolog.Logger, cli *CLI, media *mediaStore) (int, error) {
+	totalFetched := 0
+	if meta.NextToken == "" && cli.HistoryOrder == historyOrderBackward {
+		fetched, err := backfillRoomMessages(ctx, client, roomID, store, roomDirName, meta, roomLog, media)
+		totalFetched += fetched
+		if err != nil {
+			return totalFetched, err
+		}
+	}
 
-		// Small delay to avoid hammering the server
-		time.Sleep(cli.FetchDelay)
+	fetched, err := fetchAndProcessRoomMessages(ctx, client, roomID, store, roomDirName, meta, roomLog, media)
+	totalFetched += fetched
+	if err != nil {
+		return totalFetched, err
 	}
-	return currentToken, totalFetched, nil
+
+	if meta.BackfillToken != "" {
+		fetched, err := backfillRoomMessages(ctx, client, roomID, store, roomDirName, meta, roomLog, media)
+		totalFetched += fetched
+		if err != nil {
+			return totalFetched, err
+		}
+	}
+	return totalFetched, nil
 }
 
-// backupRoom handles the backup logic for a single room.
-func backupRoom(ctx context.Context, logger zerolog.Logger, client *mautrix.Client, roomID id.RoomID, cli *CLI) error {
+// backupRoom handles the backup logic for a single room. Returns the metadata
+// of the room, which has the upgrade links of the room if they are known.
+func backupRoom(ctx context.Context, logger zerolog.Logger, client *mautrix.Client, room roomMembership, cli *CLI, store backupStorage, media *mediaStore) (*Metadata, error) {
+	roomID := room.RoomID
 	roomLog := logger.With().Str("room_id", roomID.String()).Logger()
+	if room.Membership != event.MembershipJoin && room.Membership != "" {
+		roomLog = roomLog.With().Str("membership", string(room.Membership)).Logger()
+	}
 
 	roomName, err := getRoomName(ctx, roomLog, client, roomID)
 	if err != nil {
 		roomLog.Error().Err(err).Msg("Failed to get room name, skipping room")
-		return err // Skip room if we can't even get a name/ID
+		return nil, err // Skip room if we can't even get a name/ID
 	}
 	sanitizedName := sanitizeFilename(roomName)
 	if sanitizedName != roomName {
@@ -112,81 +230,100 @@ func backupRoom(ctx context.Context, logger zerolog.Logger, client *mautrix.Clie
 
 	// Construct directory name as sanitizedName:roomID
 	roomDirName := sanitizedName + ":" + roomID.String()
-	roomPath := filepath.Join(cli.BackupDir, roomDirName)
-	roomLog = roomLog.With().Str("room_dir", roomDirName).Logger()
-
-	// Ensure the target directory exists before potentially merging into it
-	if err := os.MkdirAll(roomPath, 0o755); err != nil {
-		roomLog.Error().Str("path", roomPath).Err(err).Msg("Failed to create room directory, skipping room")
-		return err
+	if room.Membership != event.MembershipJoin {
+		// The name may not be readable anymore, so keep using the existing directory
+		if existingDirName, ok := findRoomDirName(ctx, store, roomID); ok {
+			roomDirName = existingDirName
+		}
 	}
+	roomLog = roomLog.With().Str("room_dir", roomDirName).Logger()
+	ctx = roomLog.WithContext(ctx) // For the storage
 
 	// Merge data from any old directories for the same room ID
-	if err := mergeOldRoomData(cli.BackupDir, roomID, roomDirName, roomPath, roomLog); err != nil {
+	if err := mergeOldRoomData(ctx, store, roomID, roomDirName, roomLog); err != nil {
 		// Log the error but continue, as merging is best-effort
 		roomLog.Warn().Err(err).Msg("Failed to merge data from old room directories")
 	}
 
-	meta, err := readMetadata(roomPath)
+	meta, err := store.ReadMetadata(ctx, roomDirName)
 	if err != nil {
 		// Assuming readMetadata doesn't log the error itself
-		roomLog.Error().Str("path", roomPath).Err(err).Msg("Failed to read metadata, skipping room")
-		return err
+		roomLog.Error().Err(err).Msg("Failed to read metadata, skipping room")
+		return nil, err
+	}
+	if room.Membership != "" && meta.Membership != room.Membership {
+		meta.Membership = room.Membership
+		if err := store.WriteMetadata(ctx, roomDirName, meta); err != nil {
+			roomLog.Error().Err(err).Msg("Failed to write membership to metadata")
+			return nil, err
+		}
+	}
+	totalFetched, err := backupRoomMessages(ctx, client, roomID, store, roomDirName, meta, roomLog, cli, media)
+	// Also after a failure, so that the days written out of order are compacted
+	if finishErr := finishRoom(ctx, store, roomDirName); finishErr != nil {
+		roomLog.Error().Err(finishErr).Msg("Failed to compact stored events")
+		err = errors.Join(err, finishErr)
+	}
+	if err != nil && isUnreadableRoom(room, err) {
+		roomLog.Info().Err(err).Msg("Room history is not readable")
+		return meta, nil
 	}
-	finalToken, totalFetched, err := fetchAndProcessRoomMessages(ctx, client, roomID, roomPath, meta.NextToken, roomLog, cli)
 	if err != nil {
 		// Error already logged within fetchAndProcessRoomMessages or handleInvalidToken
-		return err // Propagate error to stop processing this room
+		return nil, err // Propagate error to stop processing this room
 	}
 
-	// Update metadata with the latest token for the next run
-	updateMetadataToken(roomPath, meta, finalToken, roomLog)
+	stateEvents, err := backupRoomState(ctx, client, roomID, store, roomDirName, media, roomLog)
+	if err != nil && !isUnreadableRoom(room, err) {
+		roomLog.Error().Err(err).Msg("Failed to back up room state")
+		return nil, err
+	}
+	if err := updateUpgradeLinks(ctx, store, roomDirName, meta, stateEvents, roomLog); err != nil {
+		roomLog.Error().Err(err).Msg("Failed to write upgrade links to metadata")
+		return nil, err
+	}
 
 	if totalFetched > 0 {
 		roomLog.Info().Int("total_fetched", totalFetched).Msg("Room backup finished")
 	}
-	return nil
+	return meta, nil
+}
+
+// roomIDFromDirName extracts the room ID from a room directory name of the
+// form sanitizedName:roomID.
+func roomIDFromDirName(dirName string) (id.RoomID, bool) {
+	// Find the index of the ":!" separator which marks the start of the room ID.
+	// This reliably separates the sanitized name from the actual room ID.
+	separatorIndex := strings.LastIndex(dirName, ":!")
+	if separatorIndex == -1 {
+		return "", false
+	}
+	return id.RoomID(dirName[separatorIndex+1:]), true
 }
 
-// mergeOldRoomData finds directories in backupDir belonging to the same roomID but potentially
-// different sanitized names, merges their event data into targetRoomPath, and removes the old directories.
-func mergeOldRoomData(backupDir string, roomID id.RoomID, currentRoomDirName, targetRoomPath string, roomLog zerolog.Logger) error {
-	roomIDStr := roomID.String()
-	dirEntries, err := os.ReadDir(backupDir)
+// mergeOldRoomData finds the room directories belonging to the same roomID but potentially
+// different sanitized names, merges their data into currentRoomDirName, and removes the old directories.
+func mergeOldRoomData(ctx context.Context, store backupStorage, roomID id.RoomID, currentRoomDirName string, roomLog zerolog.Logger) error {
+	roomDirNames, err := store.ListRooms(ctx)
 	if err != nil {
-		// If we can't read the backup dir, we can't merge, but it might not exist yet.
-		if os.IsNotExist(err) {
-			return nil // Nothing to merge from
-		}
-		return fmt.Errorf("failed to read backup directory %s: %w", backupDir, err)
+		return err
 	}
 
 	var mergeErrors []error
-	for _, entry := range dirEntries {
-		if !entry.IsDir() {
-			continue
-		}
-		dirName := entry.Name()
-
-		// Find the index of the ":!" separator which marks the start of the room ID.
-		// This reliably separates the sanitized name from the actual room ID.
-		separatorIndex := strings.LastIndex(dirName, ":!")
-
-		// Check if the ":!" separator was found.
-		if separatorIndex == -1 {
+	for _, dirName := range roomDirNames {
+		extractedRoomID, ok := roomIDFromDirName(dirName)
+		if !ok {
 			continue
 		}
-		// Extract the potential room ID part (starts from the '!')
-		extractedRoomID := dirName[separatorIndex+1:]
 
 		// Check if the extracted ID matches the current room ID
 		// AND that this isn't the directory we are currently processing.
-		if extractedRoomID != roomIDStr || dirName == currentRoomDirName {
+		if extractedRoomID != roomID || dirName == currentRoomDirName {
 			continue
 		}
 
 		// This directory belongs to the same room but has a different name prefix. Merge it.
-		err := processSingleOldDirectory(backupDir, dirName, targetRoomPath, roomLog)
+		err := processSingleOldDirectory(ctx, store, dirName, currentRoomDirName, roomLog)
 		if err != nil {
 			// Log the error from processing the single directory and add it to the list
 			roomLog.Error().Err(err).Str("old_dir", dirName).Msg("Failed to process old directory")
@@ -206,48 +343,62 @@ func mergeOldRoomData(backupDir string, roomID id.RoomID, currentRoomDirName, ta
 	return nil
 }
 
-// processSingleOldDirectory reads events from a specific old directory, processes them into the target path,
-// and removes the old directory. It returns an error if any step fails critically.
-func processSingleOldDirectory(backupDir, oldDirName, targetRoomPath string, roomLog zerolog.Logger) error {
-	oldDirPath := filepath.Join(backupDir, oldDirName)
-	roomLog.Info().Str("old_dir", oldDirName).Msg("Found old directory for the same room, merging data")
-
-	files, err := os.ReadDir(oldDirPath)
+// readLegacyEventFiles reads the events of the files of older versions in a
+// room directory (e.g. data.json), which are not daily event files.
+func readLegacyEventFiles(ctx context.Context, store backupStorage, dirName string) ([]*event.Event, []error) {
+	names, err := store.ListRoomFiles(ctx, dirName)
 	if err != nil {
-		// Log here, but return a wrapped error for the caller
-		roomLog.Error().Err(err).Str("path", oldDirPath).Msg("Failed to read old directory")
-		return fmt.Errorf("failed to read old dir %s: %w", oldDirName, err)
+		return nil, []error{fmt.Errorf("failed to read directory %s: %w", dirName, err)}
 	}
-
 	var allEvents []*event.Event
-	var fileReadErrors []error
-	for _, file := range files {
-		// Skip subdirectories and the metadata file within the old directory
-		if file.IsDir() || file.Name() == metadataFilename {
-			continue
-		}
+	var readErrors []error
+	for _, name := range names {
 		// Only process JSON files (assuming event data files end with .json)
-		if !strings.HasSuffix(file.Name(), ".json") {
-			roomLog.Debug().Str("file", file.Name()).Msg("Skipping non-JSON file in old directory")
+		if !strings.HasSuffix(name, ".json") || name == mediaIndexFilename || isStateFile(name) {
 			continue
 		}
-
-		filePath := filepath.Join(oldDirPath, file.Name())
-		data, err := os.ReadFile(filePath)
+		data, err := store.ReadRoomFile(ctx, dirName, name)
 		if err != nil {
-			roomLog.Error().Err(err).Str("path", filePath).Msg("Failed to read file from old directory, skipping file")
-			fileReadErrors = append(fileReadErrors, fmt.Errorf("failed to read file %s in old dir %s: %w", file.Name(), oldDirName, err))
+			readErrors = append(readErrors, fmt.Errorf("failed to read file %s/%s: %w", dirName, name, err))
 			continue // Skip this file, try others
 		}
-
 		var events []*event.Event
 		if err := json.Unmarshal(data, &events); err != nil {
-			roomLog.Error().Err(err).Str("path", filePath).Msg("Failed to unmarshal events from old file, skipping file")
-			fileReadErrors = append(fileReadErrors, fmt.Errorf("failed to unmarshal %s in old dir %s: %w", file.Name(), oldDirName, err))
+			readErrors = append(readErrors, fmt.Errorf("failed to unmarshal %s/%s: %w", dirName, name, err))
 			continue // Skip this file, try others
 		}
 		allEvents = append(allEvents, events...)
 	}
+	return allEvents, readErrors
+}
+
+// processSingleOldDirectory reads events from a specific old directory, processes them into the target path,
+// and removes the old directory. It returns an error if any step fails critically. Old directories with
+// files which could not be read are kept, so that no data is lost.
+func processSingleOldDirectory(ctx context.Context, store backupStorage, oldDirName, targetDirName string, roomLog zerolog.Logger) error {
+	roomLog.Info().Str("old_dir", oldDirName).Msg("Found old directory for the same room, merging data")
+
+	days, err := store.ListDays(ctx, oldDirName)
+	if err != nil {
+		// Log here, but return a wrapped error for the caller
+		roomLog.Error().Err(err).Str("old_dir", oldDirName).Msg("Failed to read old directory")
+		return fmt.Errorf("failed to read old dir %s: %w", oldDirName, err)
+	}
+
+	var allEvents []*event.Event
+	var fileReadErrors []error
+	for _, day := range days {
+		events, err := store.ReadDay(ctx, oldDirName, day)
+		if err != nil {
+			roomLog.Error().Err(err).Str("day", day).Msg("Failed to read events from old directory, skipping day")
+			fileReadErrors = append(fileReadErrors, fmt.Errorf("failed to read day %s in old dir %s: %w", day, oldDirName, err))
+			continue // Skip this day, try others
+		}
+		allEvents = append(allEvents, events...)
+	}
+	legacyEvents, legacyErrors := readLegacyEventFiles(ctx, store, oldDirName)
+	allEvents = append(allEvents, legacyEvents...)
+	fileReadErrors = append(fileReadErrors, legacyErrors...)
 
 	// Log accumulated file read/unmarshal errors, but proceed if we have any events
 	if len(fileReadErrors) > 0 {
@@ -260,7 +411,7 @@ func processSingleOldDirectory(backupDir, oldDirName, targetRoomPath string, roo
 
 	if len(allEvents) > 0 {
 		roomLog.Debug().Int("count", len(allEvents)).Str("old_dir", oldDirName).Msg("Processing merged events from old directory")
-		if err := processEvents(targetRoomPath, allEvents); err != nil {
+		if err := processEvents(ctx, store, targetDirName, allEvents); err != nil {
 			roomLog.Error().Err(err).Str("old_dir", oldDirName).Msg("Failed to process merged events from old directory")
 			// Return this error, as failure to process means we shouldn't remove the old dir
 			// Combine processing error with any previous file read errors for a comprehensive error message
@@ -278,43 +429,64 @@ func processSingleOldDirectory(backupDir, oldDirName, targetRoomPath string, roo
 		roomLog.Debug().Str("old_dir", oldDirName).Msg("No valid event files found in old directory to merge")
 	}
 
+	if err := mergeStateSnapshots(ctx, store, oldDirName, targetDirName); err != nil {
+		roomLog.Error().Err(err).Str("old_dir", oldDirName).Msg("Failed to merge state snapshots from old directory")
+		return fmt.Errorf("failed to merge state snapshots from old dir %s: %w", oldDirName, err)
+	}
+
+	if err := mergeMediaDirectory(ctx, store, oldDirName, targetDirName); err != nil {
+		roomLog.Error().Err(err).Str("old_dir", oldDirName).Msg("Failed to merge media from old directory")
+		return fmt.Errorf("failed to merge media from old dir %s: %w", oldDirName, err)
+	}
+
+	if err := mergeQuarantinedFiles(ctx, store, oldDirName, targetDirName); err != nil {
+		roomLog.Error().Err(err).Str("old_dir", oldDirName).Msg("Failed to move quarantined files from old directory")
+		return fmt.Errorf("failed to move quarantined files from old dir %s: %w", oldDirName, err)
+	}
+
 	// Only remove the old directory if processing succeeded (or there was nothing to process)
+	if len(fileReadErrors) > 0 {
+		return fmt.Errorf("kept old dir %s, as some of its files could not be read", oldDirName)
+	}
 	roomLog.Info().Str("old_dir", oldDirName).Msg("Removing old directory after merging")
-	if err := os.RemoveAll(oldDirPath); err != nil {
-		roomLog.Error().Err(err).Str("path", oldDirPath).Msg("Failed to remove old directory after merging")
+	if err := store.RemoveRoom(ctx, oldDirName); err != nil {
+		roomLog.Error().Err(err).Str("old_dir", oldDirName).Msg("Failed to remove old directory after merging")
 		// Return this error, but processing was successful
 		return fmt.Errorf("failed to remove old dir %s after merging: %w", oldDirName, err)
 	}
-
-	// If we had file read errors but processing succeeded and removal succeeded, return nil
-	// The warnings about file read errors have already been logged.
 	return nil
 }
 
 // initializeMatrixClient creates and verifies the Matrix client connection.
-// initializeMatrixClient creates and verifies the Matrix client connection.
-// It will retry the Whoami call if network errors or specific server errors occur.
-func initializeMatrixClient(cli *CLI, logger zerolog.Logger) (*mautrix.Client, error) {
+// All requests are retried by the transport, and the Whoami call is retried
+// further if network errors or specific server errors persist.
+// If end-to-end encryption is enabled, the crypto machinery is attached to the client,
+// and the returned function closes its store.
+func initializeMatrixClient(ctx context.Context, cli *CLI, logger zerolog.Logger) (*mautrix.Client, func() error, error) {
 	logger.Info().Msg("Initializing Matrix client instance...")
 	client, err := mautrix.NewClient(cli.Server, id.UserID(cli.User), cli.Token)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to create Matrix client instance (config issue?)")
-		return nil, fmt.Errorf("failed to create Matrix client instance: %w", err) // Non-retryable
+		return nil, nil, fmt.Errorf("failed to create Matrix client instance: %w", err) // Non-retryable
 	}
 	client.DeviceID = id.DeviceID(cli.DeviceID)
-	client.Store = mautrix.NewMemorySyncStore() // We don't need sync store for backup
+	client.Client.Transport = &retryTransport{
+		base:   newRateLimitedTransport(client.Client.Transport, cli.FetchDelay),
+		policy: retryPolicy{MaxRetries: cli.MaxRetries, BaseDelay: retryBaseDelay, MaxDelay: retryMaxDelay},
+		logger: logger,
+	}
 
 	logger.Info().Msg("Verifying credentials with Whoami call...")
 	retryCount := 0
 	for {
-		whoami, err := client.Whoami(context.Background())
+		whoami, err := client.Whoami(ctx)
 		if err == nil {
 			logger.Info().Str("user_id", whoami.UserID.String()).Str("device_id", whoami.DeviceID.String()).Msg("Successfully logged in (Whoami successful)")
 			if cli.DeviceID != "" && whoami.DeviceID != id.DeviceID(cli.DeviceID) {
 				logger.Warn().Str("expected", cli.DeviceID).Str("actual", string(whoami.DeviceID)).Msg("Logged in with different device ID than specified")
 			}
 			client.DeviceID = whoami.DeviceID // Use actual device ID from whoami response
-			return client, nil
+			break
 		}
 
 		// Whoami failed, log and check if retryable
@@ -330,79 +502,184 @@ func initializeMatrixClient(cli *CLI, logger zerolog.Logger) (*mautrix.Client, e
 			}
 		}
 
-		isRetryable := false
-		var urlErr *url.Error
-		var netOpErr *net.OpError
-
-		switch {
-		case errors.As(err, &urlErr):
-			if errors.Is(urlErr.Err, io.EOF) || errors.Is(urlErr.Err, syscall.ECONNREFUSED) || strings.Contains(strings.ToLower(urlErr.Err.Error()), "timed out") || strings.Contains(strings.ToLower(urlErr.Err.Error()), "no such host") {
-				isRetryable = true
-			}
-		case errors.As(err, &netOpErr):
-			errString := strings.ToLower(netOpErr.Err.Error())
-			if errors.Is(netOpErr.Err, syscall.ECONNREFUSED) || strings.Contains(errString, "connection refused") || strings.Contains(errString, "no such host") || strings.Contains(errString, "network is unreachable") {
-				isRetryable = true
-			}
-		case errors.Is(err, io.EOF):
-			isRetryable = true
-		}
-
-		if errors.As(err, &httpErr) && httpErr.Response != nil {
-			// Override retryable status based on HTTP status codes
-			// 4xx client errors (except 429 Too Many Requests) are generally not retryable.
-			// 5xx server errors might be temporary and thus retryable.
-			if httpErr.Response.StatusCode >= 400 && httpErr.Response.StatusCode < 500 && httpErr.Response.StatusCode != 429 {
-				isRetryable = false
-			} else if httpErr.Response.StatusCode >= 500 || httpErr.Response.StatusCode == 429 {
-				isRetryable = true
-			}
-		}
-
+		isRetryable := isRetryableError(err)
 		if isRetryable {
 			if cli.MaxWhoamiRetries > 0 && retryCount >= cli.MaxWhoamiRetries-1 { // -1 because retryCount is 0-indexed
 				logAttempt.Error().Int("max_retries", cli.MaxWhoamiRetries).Msg("Reached max retries for Whoami. Giving up.")
-				return nil, fmt.Errorf("failed to verify credentials after %d retries (Whoami failed): %w", cli.MaxWhoamiRetries, err)
+				return nil, nil, fmt.Errorf("failed to verify credentials after %d retries (Whoami failed): %w", cli.MaxWhoamiRetries, err)
 			}
 			logAttempt.Info().Dur("retry_delay", matrixConnectionRetryDelay).Msg("Server unavailable or network issue during Whoami. Retrying after delay...")
-			time.Sleep(matrixConnectionRetryDelay)
+			sleepContext(ctx, matrixConnectionRetryDelay)
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
 			retryCount++
 		} else {
 			logAttempt.Error().Msg("Non-retryable error during Whoami. Will not retry.")
-			return nil, fmt.Errorf("failed to verify credentials (Whoami failed with non-retryable error): %w", err)
+			return nil, nil, fmt.Errorf("failed to verify credentials (Whoami failed with non-retryable error): %w", err)
+		}
+	}
+
+	closeCrypto := func() error { return nil }
+	if cli.E2EE {
+		closeStore, err := initializeCrypto(ctx, client, cli, logger)
+		// Without encryption the backup is still made, with the encrypted
+		// events stored as they are, unless keys were explicitly asked for
+		if err != nil && (ctx.Err() != nil || cli.ImportKeys != "" || cli.KeyBackup) {
+			logger.Error().Err(err).Msg("Failed to initialize end-to-end encryption")
+			return nil, nil, fmt.Errorf("failed to initialize end-to-end encryption: %w", err)
+		}
+		if err != nil {
+			logger.Warn().Err(err).Msg("Failed to initialize end-to-end encryption, encrypted events are stored without decrypting them (use --no-e2ee to disable)")
+		} else {
+			closeCrypto = closeStore
 		}
 	}
+	return client, closeCrypto, nil
 }
 
-// backupJoinedRooms fetches the list of joined rooms and initiates backup for each.
-func backupJoinedRooms(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) error {
+// listRooms fetches the list of joined rooms (and left and invited rooms, if
+// enabled).
+func listRooms(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) ([]roomMembership, error) {
 	logger.Info().Msg("Fetching list of joined rooms...")
 	joinedRoomsResp, err := client.JoinedRooms(ctx)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to fetch joined rooms")
-		return err // Return error to main
+		return nil, err
 	}
 	logger.Info().Int("count", len(joinedRoomsResp.JoinedRooms)).Msg("Found joined rooms")
 
+	rooms := make([]roomMembership, 0, len(joinedRoomsResp.JoinedRooms))
+	for _, roomID := range joinedRoomsResp.JoinedRooms {
+		rooms = append(rooms, roomMembership{RoomID: roomID, Membership: event.MembershipJoin})
+	}
+	if cli.IncludeLeft {
+		otherRooms, err := discoverOtherRooms(ctx, client)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to fetch left and invited rooms")
+			return nil, err
+		}
+		logger.Info().Int("count", len(otherRooms)).Msg("Found left and invited rooms")
+		rooms = append(rooms, otherRooms...)
+	}
+	return rooms, nil
+}
+
+// prepareBackupDir creates the backup directory and opens the storage, and
+// opens the media store unless media downloads are disabled (in which case
+// the media store is nil).
+func prepareBackupDir(ctx context.Context, cli *CLI, logger zerolog.Logger) (backupStorage, *mediaStore, error) {
 	// Create base backup directory
 	if err := os.MkdirAll(cli.BackupDir, 0o755); err != nil {
 		logger.Error().Str("dir", cli.BackupDir).Err(err).Msg("Failed to create base backup directory")
+		return nil, nil, err
+	}
+	store, err := openStorage(ctx, cli)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open storage")
+		return nil, nil, err
+	}
+	if !cli.Media {
+		return store, nil, nil
+	}
+	media, err := openMediaStore(store)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open media store")
+		return nil, nil, err
+	}
+	return store, media, nil
+}
+
+// backupRooms fetches the list of joined rooms (and left and invited rooms,
+// if enabled) and initiates backup for each.
+func backupRooms(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) error {
+	rooms, err := listRooms(ctx, client, cli, logger)
+	if err != nil {
 		return err // Return error to main
 	}
+	store, media, err := prepareBackupDir(ctx, cli, logger)
+	if err != nil {
+		return err // Return error to main
+	}
+	defer closeStorage(store, logger)
+	return backupRoomList(ctx, client, rooms, cli, store, media, logger)
+}
+
+// backupRoomList initiates backup for each of the rooms, and for the rooms of
+// their upgrade chains if enabled.
+func backupRoomList(ctx context.Context, client *mautrix.Client, rooms []roomMembership, cli *CLI, store backupStorage, media *mediaStore, logger zerolog.Logger) error {
+	seenRooms := make(map[id.RoomID]bool, len(rooms))
+	for _, room := range rooms {
+		seenRooms[room.RoomID] = true
+	}
 
-	// Backup each room
+	type roomResult struct {
+		room roomMembership
+		meta *Metadata
+		err  error
+	}
+	jobs := make(chan roomMembership)
+	results := make(chan roomResult)
+	for range max(cli.Parallel, 1) {
+		go func() {
+			for room := range jobs {
+				meta, err := backupRoom(ctx, logger, client, room, cli, store, media)
+				results <- roomResult{room: room, meta: meta, err: err}
+			}
+		}()
+	}
+
+	// Backup each room, dispatching the rooms to the workers until all are done
 	var backupErrors []error
-	for _, roomID := range joinedRoomsResp.JoinedRooms {
-		err := backupRoom(ctx, logger, client, roomID, cli)
-		if err != nil {
-			// Error is already logged within backupRoom or its helpers
-			// Collect errors to report at the end, but continue processing other rooms
-			// Log the specific room error here for context at this level
-			logger.Error().Str("room_id", roomID.String()).Err(err).Msg("Failed to back up room")
-			backupErrors = append(backupErrors, fmt.Errorf("room %s: %w", roomID.String(), err))
+	queue := slices.Clone(rooms)
+	inProgress := 0
+	for len(queue) > 0 || inProgress > 0 {
+		if ctx.Err() != nil {
+			// Interrupted, let the workers finish the rooms in progress
+			queue = nil
+		}
+		var nextJobs chan roomMembership // nil (never ready) when the queue is empty
+		var nextRoom roomMembership
+		if len(queue) > 0 {
+			nextJobs, nextRoom = jobs, queue[0]
+		}
+		select {
+		case nextJobs <- nextRoom:
+			queue = queue[1:]
+			inProgress++
+		case result := <-results:
+			inProgress--
+			roomID := result.room.RoomID
+			if result.err != nil && ctx.Err() != nil && errors.Is(result.err, ctx.Err()) {
+				logger.Info().Str("room_id", roomID.String()).Msg("Room backup interrupted")
+				continue
+			}
+			if result.err != nil {
+				// Error is already logged within backupRoom or its helpers
+				// Collect errors to report at the end, but continue processing other rooms
+				// Log the specific room error here for context at this level
+				logger.Error().Str("room_id", roomID.String()).Err(result.err).Msg("Failed to back up room")
+				backupErrors = append(backupErrors, fmt.Errorf("room %s: %w", roomID.String(), result.err))
+				continue
+			}
+			if !cli.FollowUpgrades {
+				continue
+			}
+			// Follow the upgrade chain to rooms not otherwise backed up
+			for _, linkedRoomID := range []id.RoomID{result.meta.Predecessor, result.meta.Successor} {
+				if linkedRoomID != "" && !seenRooms[linkedRoomID] {
+					seenRooms[linkedRoomID] = true
+					logger.Info().Str("room_id", roomID.String()).Str("linked_room_id", linkedRoomID.String()).Msg("Following room upgrade link")
+					queue = append(queue, roomMembership{RoomID: linkedRoomID})
+				}
+			}
 		}
 	}
+	close(jobs)
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if len(backupErrors) > 0 {
 		logger.Error().Int("error_count", len(backupErrors)).Msg("One or more rooms failed to back up completely")
 		// Individual errors already logged above
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// testFailOnce is a response of the test homeserver which fails on its first request.
+type testFailOnce struct {
+	response any
+}
+
+// testRequestCounter counts the requests made to the test homeserver.
+type testRequestCounter struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// add counts a request of the key, returning the number of its requests.
+func (self *testRequestCounter) add(key string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[key]++
+	return self.counts[key]
+}
+
+// count returns the number of requests of the path, or of the /messages
+// response key.
+func (self *testRequestCounter) count(key string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.counts[key]
+}
+
+// newTestHomeserver serves the given responses by path, as JSON or as they
+// are if they are []byte, and M_NOT_FOUND for everything else. The /messages
+// responses of the test room can be keyed by direction and from token (e.g.
+// "b:token") instead. Responses which are a mautrix.RespError are returned as
+// errors, and testFailOnce responses fail on their first request. Returns the
+// server and a counter of the requests.
+func newTestHomeserver(t *testing.T, responses map[string]any) (*httptest.Server, *testRequestCounter) {
+	t.Helper()
+	requests := &testRequestCounter{counts: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		keyRequests := requests.add(key)
+		if key == testRoomMessagesPath {
+			if pageKey := r.URL.Query().Get("dir") + ":" + r.URL.Query().Get("from"); responses[pageKey] != nil {
+				key = pageKey
+				keyRequests = requests.add(key)
+			}
+		}
+		response, ok := responses[key]
+		if failing, isFailing := response.(testFailOnce); isFailing {
+			response = failing.response
+			if keyRequests == 1 {
+				mautrix.MUnknown.WithMessage("Internal error").Write(w)
+				return
+			}
+		}
+		switch response := response.(type) {
+		case mautrix.RespError:
+			response.Write(w)
+		case []byte:
+			_, _ = w.Write(response)
+		default:
+			if !ok {
+				mautrix.MNotFound.WithMessage("Not found").Write(w)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(response)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestFetchWithInvalidToken(t *testing.T) {
+	ctx := context.Background()
+	roomPath := t.TempDir()
+	roomDirName := filepath.Base(roomPath)
+	store := newFileStorage(filepath.Dir(roomPath))
+	day := testBackfillDay.UnixMilli()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$a", day, "a"), newTestEvent("$b", day+1, "b")}))
+	server, _ := newTestHomeserver(t, map[string]any{
+		"f:stale": mautrix.MUnknown.WithMessage("Unknown token").WithStatus(400),
+		"/_matrix/client/v3/rooms/!room:example.org/context/$b": map[string]any{
+			"start": "before-b", "end": "after-c", "events_after": []any{newTestMessagesEvent("$c", "m.room.message", 1)},
+		},
+		"f:after-c": map[string]any{"start": "after-c", "end": "after-c", "chunk": []any{}},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+
+	meta := &Metadata{NextToken: "stale"}
+	fetched, err := fetchAndProcessRoomMessages(ctx, client, testRoomID, store, roomDirName, meta, zerolog.Nop(), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, meta.NextToken, "after-c")
+	assert.Equal(t, fetched, 1)
+	newest, err := storedEdgeEvent(ctx, store, roomDirName, true)
+	assert.NilError(t, err)
+	assert.Equal(t, newest.ID.String(), "$c")
+	oldest, err := storedEdgeEvent(ctx, store, roomDirName, false)
+	assert.NilError(t, err)
+	assert.Equal(t, oldest.ID.String(), "$a")
+}
+
+func TestBackupRoomListParallel(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	responses := map[string]any{
+		"/_matrix/client/v3/rooms/!a:example.org/state": []any{
+			map[string]any{"type": "m.room.tombstone", "state_key": "", "event_id": "$tombstone", "content": map[string]any{"replacement_room": "!c:example.org"}},
+		},
+	}
+	for _, roomID := range []string{"!a:example.org", "!b:example.org", "!c:example.org", "!broken:example.org"} {
+		responses[fmt.Sprintf("/_matrix/client/v3/rooms/%s/messages", roomID)] = map[string]any{"start": "now", "chunk": []any{}}
+		if _, ok := responses[fmt.Sprintf("/_matrix/client/v3/rooms/%s/state", roomID)]; !ok && roomID != "!broken:example.org" {
+			responses[fmt.Sprintf("/_matrix/client/v3/rooms/%s/state", roomID)] = []any{}
+		}
+	}
+	server, _ := newTestHomeserver(t, responses)
+	client := newTestServerCryptoMachine(t, server).client
+	cli := &CLI{BackupDir: backupDir, HistoryOrder: historyOrderBackward, Parallel: 2, FollowUpgrades: true}
+	rooms := []roomMembership{
+		{RoomID: "!a:example.org", Membership: event.MembershipJoin},
+		{RoomID: "!b:example.org", Membership: event.MembershipJoin},
+		{RoomID: "!broken:example.org", Membership: event.MembershipJoin},
+	}
+
+	// The failing room does not stop the others, and the successor room is backed up too
+	assert.ErrorContains(t, backupRoomList(context.Background(), client, rooms, cli, store, nil, zerolog.Nop()), "one or more room backups failed")
+	for _, roomID := range []id.RoomID{"!a:example.org", "!b:example.org", "!c:example.org"} {
+		dirName, ok := findRoomDirName(ctx, store, roomID)
+		assert.Assert(t, ok, roomID)
+		meta, err := store.ReadMetadata(ctx, dirName)
+		assert.NilError(t, err)
+		assert.Equal(t, meta.NextToken, "now")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (self roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return self(req)
+}
+
+func TestBackupRoomMessagesInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	roomPath := t.TempDir()
+	roomDirName := filepath.Base(roomPath)
+	store := newFileStorage(filepath.Dir(roomPath))
+	server, _ := newTestHomeserver(t, map[string]any{
+		"f:t0": map[string]any{"start": "t0", "end": "t1", "chunk": []any{newTestMessagesEvent("$a", "m.room.message", 0)}},
+		"f:t1": map[string]any{"start": "t1", "end": "t2", "chunk": []any{newTestMessagesEvent("$b", "m.room.message", 0)}},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	base := client.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// Interrupted while fetching the second chunk
+	client.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("from") == "t1" {
+			cancel()
+		}
+		return base.RoundTrip(req)
+	})
+	meta := &Metadata{NextToken: "t0"}
+
+	fetched, err := backupRoomMessages(ctx, client, testRoomID, store, roomDirName, meta, zerolog.Nop(), &CLI{HistoryOrder: "forward"}, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, fetched, 1)
+	stored, err := store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, stored.NextToken, "t1")
+	newest, err := storedEdgeEvent(ctx, store, roomDirName, true)
+	assert.NilError(t, err)
+	assert.Equal(t, newest.ID.String(), "$a")
+}
+
+func TestFetchCheckpointsEachChunk(t *testing.T) {
+	ctx := context.Background()
+	roomPath := t.TempDir()
+	roomDirName := filepath.Base(roomPath)
+	store := newFileStorage(filepath.Dir(roomPath))
+	server, _ := newTestHomeserver(t, map[string]any{
+		"f:t0": map[string]any{"start": "t0", "end": "t1", "chunk": []any{newTestMessagesEvent("$a", "m.room.message", 0)}},
+		"f:t1": map[string]any{"start": "t1", "end": "t2", "chunk": []any{newTestMessagesEvent("$b", "m.room.message", 0)}},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+
+	// The third request fails, the token of the second chunk is kept
+	fetched, err := fetchAndProcessRoomMessages(context.Background(), client, testRoomID, store, roomDirName, &Metadata{NextToken: "t0"}, zerolog.Nop(), nil)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	assert.Equal(t, fetched, 2)
+	stored, err := store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, stored.NextToken, "t2")
+}
+
+func TestInitializeMatrixClientE2EEFailure(t *testing.T) {
+	ctx := context.Background()
+	// The server knows nothing of the encryption endpoints
+	server, _ := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/account/whoami": map[string]any{"user_id": "@user:example.org", "device_id": "DEVICE"},
+	})
+	cli := &CLI{Server: server.URL, User: "@user:example.org", Token: "token", BackupDir: t.TempDir(), E2EE: true}
+
+	// The backup is made without decrypting
+	client, closeCrypto, err := initializeMatrixClient(ctx, cli, zerolog.Nop())
+	assert.NilError(t, err)
+	assert.Assert(t, client.Crypto == nil)
+	assert.NilError(t, closeCrypto())
+
+	// An explicitly requested key import still fails the run
+	cli.ImportKeys = filepath.Join(t.TempDir(), "missing.txt")
+	_, _, err = initializeMatrixClient(ctx, cli, zerolog.Nop())
+	assert.ErrorContains(t, err, "failed to initialize end-to-end encryption")
+}
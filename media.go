@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	mediaDirName       = "media"
+	mediaIndexFilename = "media.json"
+)
+
+// mediaURLKeys are the content keys which contain mxc:// URIs to download,
+// at any depth (e.g. url, info.thumbnail_url, file.url, avatar_url).
+var mediaURLKeys = map[string]bool{
+	"url":           true,
+	"avatar_url":    true,
+	"thumbnail_url": true,
+}
+
+// mediaIndex maps mxc:// URIs to the downloaded files, as slash separated
+// paths relative to the room directory.
+type mediaIndex map[id.ContentURIString]string
+
+// readMediaIndex loads the media index of a room.
+func readMediaIndex(ctx context.Context, store backupStorage, roomDirName string) (mediaIndex, error) {
+	data, err := store.ReadRoomFile(ctx, roomDirName, mediaIndexFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media index of %s: %w", roomDirName, err)
+	}
+	index := make(mediaIndex)
+	if data == nil {
+		return index, nil
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal media index of %s: %w", roomDirName, err)
+	}
+	return index, nil
+}
+
+// writeMediaIndex saves the media index of a room.
+func writeMediaIndex(ctx context.Context, store backupStorage, roomDirName string, index mediaIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal media index: %w", err)
+	}
+	if err := store.WriteRoomFile(ctx, roomDirName, mediaIndexFilename, data); err != nil {
+		return fmt.Errorf("failed to write media index of %s: %w", roomDirName, err)
+	}
+	return nil
+}
+
+// mediaRef is a media URI found in event content, with the decryption info
+// for encrypted attachments.
+type mediaRef struct {
+	URI  id.ContentURI
+	File *attachment.EncryptedFile
+}
+
+// parseEncryptedFile parses an encrypted attachment object (e.g. file or
+// info.thumbnail_file), which has the key and IV next to the URL.
+func parseEncryptedFile(value map[string]any) (mediaRef, bool) {
+	_, hasKey := value["key"]
+	_, hasIV := value["iv"]
+	if !hasKey || !hasIV {
+		return mediaRef{}, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return mediaRef{}, false
+	}
+	var fileInfo event.EncryptedFileInfo
+	if err := json.Unmarshal(data, &fileInfo); err != nil {
+		return mediaRef{}, false
+	}
+	uri, err := fileInfo.URL.Parse()
+	if err != nil {
+		return mediaRef{}, false
+	}
+	return mediaRef{URI: uri, File: &fileInfo.EncryptedFile}, true
+}
+
+// collectMedia finds the media references in the (raw) event content.
+func collectMedia(value any, refs []mediaRef) []mediaRef {
+	switch typed := value.(type) {
+	case map[string]any:
+		if ref, ok := parseEncryptedFile(typed); ok {
+			return append(refs, ref)
+		}
+		for key, child := range typed {
+			if str, ok := child.(string); ok && mediaURLKeys[key] {
+				if uri, err := id.ParseContentURI(str); err == nil {
+					refs = append(refs, mediaRef{URI: uri})
+				}
+				continue
+			}
+			refs = collectMedia(child, refs)
+		}
+	case []any:
+		for _, child := range typed {
+			refs = collectMedia(child, refs)
+		}
+	}
+	return refs
+}
+
+// downloadEventMedia downloads the media referenced by the events to the
+// media store, unless it is there already, and records it in the room's media
+// index. Failed downloads are only logged, as media may well have been purged
+// from the server.
+func downloadEventMedia(ctx context.Context, client *mautrix.Client, store *mediaStore, roomDirName string, events []*event.Event, roomLog zerolog.Logger) error {
+	index, err := readMediaIndex(ctx, store.storage, roomDirName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	downloaded, failed := 0, 0
+	for _, evt := range events {
+		for _, ref := range collectMedia(contentRaw(&evt.Content), nil) {
+			uriString := ref.URI.CUString()
+			contentHash, err := store.lookup(ctx, uriString)
+			if err != nil {
+				return err
+			}
+			if contentHash == "" {
+				contentHash, err = store.download(ctx, client, ref)
+				if err != nil && ctx.Err() != nil {
+					// Not a missing media, the events are processed again on the next run
+					return ctx.Err()
+				}
+				if err != nil {
+					roomLog.Warn().Err(err).Str("event_id", evt.ID.String()).Str("mxc", ref.URI.String()).Bool("encrypted", ref.File != nil).Msg("Failed to download media")
+					failed++
+					continue
+				}
+				downloaded++
+			}
+			if relPath := roomMediaPath(contentHash); index[uriString] != relPath {
+				index[uriString] = relPath
+				changed = true
+			}
+		}
+	}
+
+	if downloaded > 0 || failed > 0 {
+		roomLog.Debug().Int("downloaded", downloaded).Int("failed", failed).Msg("Downloaded media")
+	}
+	if changed {
+		return writeMediaIndex(ctx, store.storage, roomDirName, index)
+	}
+	return nil
+}
+
+// mergeMediaDirectory merges the media index of an old room directory into
+// the target room directory. The media itself is in the shared media store.
+func mergeMediaDirectory(ctx context.Context, store backupStorage, oldDirName, targetDirName string) error {
+	oldIndex, err := readMediaIndex(ctx, store, oldDirName)
+	if err != nil || len(oldIndex) == 0 {
+		return err
+	}
+	index, err := readMediaIndex(ctx, store, targetDirName)
+	if err != nil {
+		return err
+	}
+	for uri, relPath := range oldIndex {
+		if _, ok := index[uri]; !ok {
+			index[uri] = relPath
+		}
+	}
+	return writeMediaIndex(ctx, store, targetDirName, index)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testMediaURI          = "mxc://example.org/image"
+	testMediaContent      = "image data"
+	testMediaDownloadPath = "/_matrix/client/v1/media/download/"
+)
+
+func newTestMediaEvent(t *testing.T, eventID string, content string) *event.Event {
+	t.Helper()
+	evt := &event.Event{ID: id.EventID(eventID), Timestamp: 1, Type: event.EventMessage}
+	assert.NilError(t, json.Unmarshal([]byte(content), &evt.Content))
+	return evt
+}
+
+// newTestEncryptedMedia encrypts the data like clients do for attachments
+// in encrypted rooms, and returns the ciphertext and the file info.
+func newTestEncryptedMedia(t *testing.T, uri string, plaintext string) ([]byte, string) {
+	t.Helper()
+	encryptedFile := attachment.NewEncryptedFile()
+	ciphertext := []byte(plaintext)
+	encryptedFile.EncryptInPlace(ciphertext)
+	fileInfo, err := json.Marshal(event.EncryptedFileInfo{EncryptedFile: *encryptedFile, URL: id.ContentURIString(uri)})
+	assert.NilError(t, err)
+	return ciphertext, string(fileInfo)
+}
+
+func TestCollectMedia(t *testing.T) {
+	evt := newTestMediaEvent(t, "$image", `{
+		"msgtype": "m.image",
+		"body": "mxc://example.org/not_in_url_key",
+		"url": "mxc://example.org/image",
+		"info": {"thumbnail_url": "mxc://example.org/thumb"},
+		"file": {"url": "mxc://example.org/encrypted", "key": {}, "iv": ""},
+		"avatars": [{"avatar_url": "mxc://example.org/avatar"}, {"avatar_url": "https://example.org/avatar"}]
+	}`)
+	var uris []string
+	for _, ref := range collectMedia(contentRaw(&evt.Content), nil) {
+		uris = append(uris, ref.URI.String())
+		assert.Equal(t, ref.File != nil, ref.URI.FileID == "encrypted")
+	}
+	sort.Strings(uris)
+	assert.DeepEqual(t, uris, []string{
+		"mxc://example.org/avatar",
+		"mxc://example.org/encrypted",
+		"mxc://example.org/image",
+		"mxc://example.org/thumb",
+	})
+}
+
+// newTestMediaStore creates a media store in a new backup directory, and
+// returns it with the directory name of the test room.
+func newTestMediaStore(t *testing.T) (*mediaStore, string) {
+	t.Helper()
+	backupDir := t.TempDir()
+	store, err := openMediaStore(newFileStorage(backupDir))
+	assert.NilError(t, err)
+	return store, "Room:" + testRoomID.String()
+}
+
+func testContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// readRoomMedia reads the media file of the URI through the room's media index.
+func readRoomMedia(t *testing.T, store *mediaStore, roomDirName string, uri id.ContentURIString) string {
+	t.Helper()
+	index, err := readMediaIndex(context.Background(), store.storage, roomDirName)
+	assert.NilError(t, err)
+	relPath, ok := index[uri]
+	assert.Assert(t, ok, "%s not in media index", uri)
+	data, err := os.ReadFile(filepath.Join(store.storage.(*fileStorage).dir, roomDirName, filepath.FromSlash(relPath)))
+	assert.NilError(t, err)
+	return string(data)
+}
+
+func TestDownloadEventMedia(t *testing.T) {
+	ctx := context.Background()
+	server, requests := newTestHomeserver(t, map[string]any{
+		testMediaDownloadPath + "example.org/image": []byte(testMediaContent),
+		testMediaDownloadPath + "example.org/copy":  []byte(testMediaContent),
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	store, roomDirName := newTestMediaStore(t)
+	events := []*event.Event{
+		newTestMediaEvent(t, "$image", `{"msgtype": "m.image", "url": "`+testMediaURI+`"}`),
+		newTestMediaEvent(t, "$missing", `{"msgtype": "m.file", "url": "mxc://example.org/purged"}`),
+	}
+
+	assert.NilError(t, downloadEventMedia(ctx, client, store, roomDirName, events, zerolog.Nop()))
+	index, err := readMediaIndex(ctx, store.storage, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, index, mediaIndex{testMediaURI: "../media/" + blobRelPath(testContentHash(testMediaContent))})
+	assert.Equal(t, readRoomMedia(t, store, roomDirName, testMediaURI), testMediaContent)
+	assert.Equal(t, requests.count(testMediaDownloadPath+"example.org/image"), 1)
+	assert.Equal(t, requests.count(testMediaDownloadPath+"example.org/purged"), 1)
+
+	// Downloaded media is not fetched again, failed media is retried
+	assert.NilError(t, downloadEventMedia(ctx, client, store, roomDirName, events, zerolog.Nop()))
+	assert.Equal(t, requests.count(testMediaDownloadPath+"example.org/image"), 1)
+	assert.Equal(t, requests.count(testMediaDownloadPath+"example.org/purged"), 2)
+
+	t.Run("Shared between rooms", func(t *testing.T) {
+		otherDirName := "Other:!other:example.org"
+		otherEvents := []*event.Event{
+			newTestMediaEvent(t, "$forwarded", `{"msgtype": "m.image", "url": "`+testMediaURI+`"}`),
+			newTestMediaEvent(t, "$copy", `{"msgtype": "m.image", "url": "mxc://example.org/copy"}`),
+		}
+		assert.NilError(t, downloadEventMedia(ctx, client, store, otherDirName, otherEvents, zerolog.Nop()))
+		assert.Equal(t, requests.count(testMediaDownloadPath+"example.org/image"), 1)
+		assert.Equal(t, requests.count(testMediaDownloadPath+"example.org/copy"), 1)
+		otherIndex, err := readMediaIndex(ctx, store.storage, otherDirName)
+		assert.NilError(t, err)
+		assert.Equal(t, otherIndex[testMediaURI], index[testMediaURI])
+		assert.Equal(t, otherIndex["mxc://example.org/copy"], index[testMediaURI])
+	})
+
+	t.Run("Index persists", func(t *testing.T) {
+		reopened, err := openMediaStore(newFileStorage(store.storage.(*fileStorage).dir))
+		assert.NilError(t, err)
+		contentHash, err := reopened.lookup(ctx, testMediaURI)
+		assert.NilError(t, err)
+		assert.Equal(t, contentHash, testContentHash(testMediaContent))
+	})
+}
+
+func TestDownloadEncryptedMedia(t *testing.T) {
+	ctx := context.Background()
+	ciphertext, fileInfo := newTestEncryptedMedia(t, "mxc://example.org/encrypted", testMediaContent)
+	tampered, tamperedInfo := newTestEncryptedMedia(t, "mxc://example.org/tampered", "tampered")
+	tampered[0] ^= 0xff
+	server, _ := newTestHomeserver(t, map[string]any{
+		testMediaDownloadPath + "example.org/encrypted": ciphertext,
+		testMediaDownloadPath + "example.org/tampered":  tampered,
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	store, roomDirName := newTestMediaStore(t)
+	events := []*event.Event{
+		newTestMediaEvent(t, "$encrypted", `{"msgtype": "m.image", "file": `+fileInfo+`}`),
+		newTestMediaEvent(t, "$tampered", `{"msgtype": "m.image", "file": `+tamperedInfo+`}`),
+	}
+
+	assert.NilError(t, downloadEventMedia(ctx, client, store, roomDirName, events, zerolog.Nop()))
+	assert.Equal(t, readRoomMedia(t, store, roomDirName, "mxc://example.org/encrypted"), testMediaContent)
+	contentHash, err := store.lookup(ctx, "mxc://example.org/tampered")
+	assert.NilError(t, err)
+	assert.Equal(t, contentHash, "")
+	tmpFiles, err := os.ReadDir(store.tmpDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tmpFiles), 0)
+}
+
+func TestMergeMediaDirectory(t *testing.T) {
+	ctx := context.Background()
+	store, roomDirName := newTestMediaStore(t)
+	oldDirName := "Old name:" + testRoomID.String()
+	oldPath := roomMediaPath(testContentHash("old"))
+	assert.NilError(t, writeMediaIndex(ctx, store.storage, oldDirName, mediaIndex{testMediaURI: oldPath, "mxc://example.org/other": oldPath}))
+	currentPath := roomMediaPath(testContentHash(testMediaContent))
+	assert.NilError(t, writeMediaIndex(ctx, store.storage, roomDirName, mediaIndex{testMediaURI: currentPath}))
+
+	assert.NilError(t, mergeMediaDirectory(ctx, store.storage, oldDirName, roomDirName))
+	index, err := readMediaIndex(ctx, store.storage, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, index, mediaIndex{testMediaURI: currentPath, "mxc://example.org/other": oldPath})
+}
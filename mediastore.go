@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	mediaStoreIndexFilename = "index.jsonl"
+	mediaStoreTmpDirName    = "tmp"
+)
+
+// mediaStoreEntry is a line of the media store index of the file storage.
+type mediaStoreEntry struct {
+	URI    id.ContentURIString `json:"mxc"`
+	SHA256 string              `json:"sha256"`
+}
+
+// mediaStore is the content-addressed media store shared by all rooms in the
+// media directory of the backup. Blobs are stored once by the SHA-256 hash of
+// their (plaintext) content, and the storage maps mxc:// URIs to the hashes.
+// Blobs are always complete before they are referenced, so an interrupted run
+// leaves at worst an unreferenced blob.
+type mediaStore struct {
+	storage backupStorage // Where the blobs and the references are kept
+	tmpDir  string
+
+	lock sync.Mutex
+}
+
+// openMediaStore opens the media store of the storage, removing the
+// leftovers of interrupted downloads.
+func openMediaStore(storage backupStorage) (*mediaStore, error) {
+	self := &mediaStore{storage: storage, tmpDir: storage.TempDir()}
+	if err := os.RemoveAll(self.tmpDir); err != nil {
+		return nil, fmt.Errorf("failed to clean media store temporary directory: %w", err)
+	}
+	if err := os.MkdirAll(self.tmpDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create media store directory: %w", err)
+	}
+	return self, nil
+}
+
+// blobRelPath returns the slash separated path of a blob relative to the store directory.
+func blobRelPath(hash string) string {
+	return hash[:2] + "/" + hash
+}
+
+// roomMediaPath returns the slash separated path of a blob relative to a room directory.
+func roomMediaPath(hash string) string {
+	return "../" + mediaDirName + "/" + blobRelPath(hash)
+}
+
+// lookup returns the hash of the stored media for the URI, or "" if it is not
+// in the store.
+func (self *mediaStore) lookup(ctx context.Context, uri id.ContentURIString) (string, error) {
+	hash, err := self.storage.MediaHash(ctx, uri)
+	if err != nil || hash == "" {
+		return "", err
+	}
+	stored, err := self.storage.HasBlob(ctx, hash)
+	if err != nil || !stored {
+		return "", err
+	}
+	return hash, nil
+}
+
+// addBlob moves the complete file at path to the store (unless the same
+// content is already there), and records it as the media of the URI.
+func (self *mediaStore) addBlob(ctx context.Context, uri id.ContentURIString, path string, hash string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stored, err := self.storage.HasBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if stored {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove duplicate media file %s: %w", path, err)
+		}
+	} else if err := self.storage.PutBlob(ctx, hash, path); err != nil {
+		return err
+	}
+	return self.storage.AddMedia(ctx, uri, hash)
+}
+
+// writeTempFile copies the reader to a new temporary file in the store,
+// returning its path and the SHA-256 hash of the content.
+func (self *mediaStore) writeTempFile(reader io.Reader, verify func() error) (string, string, error) {
+	file, err := os.CreateTemp(self.tmpDir, "media-*")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create temporary media file: %w", err)
+	}
+	contentHash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, contentHash), reader)
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err = errors.Join(err, file.Close()); err != nil {
+		_ = os.Remove(file.Name())
+		return "", "", fmt.Errorf("failed to write temporary media file: %w", err)
+	}
+	return file.Name(), hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+// download fetches the media to the store, decrypting (and verifying)
+// encrypted attachments. Returns the hash of the stored content.
+func (self *mediaStore) download(ctx context.Context, client *mautrix.Client, ref mediaRef) (string, error) {
+	if ref.File != nil {
+		if err := ref.File.PrepareForDecryption(); err != nil {
+			return "", fmt.Errorf("unable to decrypt %s: %w", ref.URI, err)
+		}
+	}
+	resp, err := client.Download(ctx, ref.URI)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", ref.URI, err)
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	var verify func() error
+	if ref.File != nil {
+		// DecryptStream does not verify the hash, so hash the ciphertext here
+		ciphertextHash := sha256.New()
+		body = ref.File.DecryptStream(io.TeeReader(resp.Body, ciphertextHash))
+		verify = func() error {
+			if base64.RawStdEncoding.EncodeToString(ciphertextHash.Sum(nil)) != strings.TrimRight(ref.File.Hashes.SHA256, "=") {
+				return attachment.HashMismatch
+			}
+			return nil
+		}
+	}
+	tmpPath, contentHash, err := self.writeTempFile(body, verify)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", ref.URI, err)
+	}
+	return contentHash, self.addBlob(ctx, ref.URI.CUString(), tmpPath, contentHash)
+}
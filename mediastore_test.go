@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMediaStoreInterruptedRun(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store, err := openMediaStore(newFileStorage(backupDir))
+	assert.NilError(t, err)
+	contentHash := testContentHash(testMediaContent)
+	tmpPath := filepath.Join(store.tmpDir, "media-1")
+	assert.NilError(t, os.WriteFile(tmpPath, []byte(testMediaContent), 0o644))
+	assert.NilError(t, store.addBlob(ctx, testMediaURI, tmpPath, contentHash))
+
+	// Simulate a run interrupted while downloading and writing the index
+	indexPath := filepath.Join(backupDir, mediaDirName, mediaStoreIndexFilename)
+	file, err := os.OpenFile(indexPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.NilError(t, err)
+	_, err = file.WriteString(`{"mxc":"mxc://example.org/partial","sha`)
+	assert.NilError(t, err)
+	assert.NilError(t, file.Close())
+	assert.NilError(t, os.WriteFile(filepath.Join(store.tmpDir, "media-2"), []byte("partial"), 0o644))
+
+	reopened, err := openMediaStore(newFileStorage(backupDir))
+	assert.NilError(t, err)
+	tmpFiles, err := os.ReadDir(store.tmpDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tmpFiles), 0)
+	storedHash, err := reopened.lookup(ctx, "mxc://example.org/partial")
+	assert.NilError(t, err)
+	assert.Equal(t, storedHash, "")
+
+	// Same content under another URI is stored only once
+	tmpPath = filepath.Join(store.tmpDir, "media-3")
+	assert.NilError(t, os.WriteFile(tmpPath, []byte(testMediaContent), 0o644))
+	assert.NilError(t, reopened.addBlob(ctx, "mxc://example.org/copy", tmpPath, contentHash))
+	assert.Assert(t, !fileExists(tmpPath))
+
+	reopened, err = openMediaStore(newFileStorage(backupDir))
+	assert.NilError(t, err)
+	for _, uri := range []string{testMediaURI, "mxc://example.org/copy"} {
+		storedHash, err := reopened.lookup(ctx, id.ContentURIString(uri))
+		assert.NilError(t, err)
+		assert.Equal(t, storedHash, contentHash, uri)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestLimiter spaces the requests by at least the interval, no matter how
+// many workers make them.
+type requestLimiter struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time // Earliest time of the next request
+}
+
+// wait blocks until the next request may be made, or the context is cancelled.
+func (self *requestLimiter) wait(ctx context.Context) error {
+	self.lock.Lock()
+	at := time.Now()
+	if self.next.After(at) {
+		at = self.next
+	}
+	self.next = at.Add(self.interval)
+	self.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitedTransport is a http.RoundTripper which applies the request
+// limiter to all requests to the server.
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *requestLimiter
+}
+
+func newRateLimitedTransport(base http.RoundTripper, interval time.Duration) *rateLimitedTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitedTransport{base: base, limiter: &requestLimiter{interval: interval}}
+}
+
+func (self *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := self.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return self.base.RoundTrip(req)
+}
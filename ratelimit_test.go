@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := &requestLimiter{interval: 20 * time.Millisecond}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Check(t, limiter.wait(ctx))
+		}()
+	}
+	wg.Wait()
+	assert.Assert(t, time.Since(start) >= 60*time.Millisecond)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	limiter.interval = time.Hour
+	assert.NilError(t, limiter.wait(ctx))
+	assert.ErrorIs(t, limiter.wait(cancelled), context.Canceled)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var errRedecryptWithoutE2EE = errors.New("redecrypt requires end-to-end encryption (--e2ee)")
+
+// redecryptRoom tries to decrypt the stored encrypted events of a room
+// directory with the current room keys, and merges the decrypted events back
+// into the daily files. Media of the decrypted events is downloaded too
+// (unless media is nil), as encrypted attachments can be found only now.
+// Returns the number of decrypted and still encrypted events.
+func redecryptRoom(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, media *mediaStore, roomLog zerolog.Logger) (int, int, error) {
+	days, err := store.ListDays(ctx, roomDirName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	totalDecrypted, totalFailed := 0, 0
+	for _, day := range days {
+		events, err := store.ReadDay(ctx, roomDirName, day)
+		if err != nil {
+			return totalDecrypted, totalFailed, err
+		}
+
+		var encrypted []*event.Event
+		for _, evt := range events {
+			if evt.Type.Type == event.EventEncrypted.Type {
+				encrypted = append(encrypted, evt)
+			}
+		}
+		if len(encrypted) == 0 {
+			continue
+		}
+		totalFailed += decryptEvents(ctx, client.Crypto, roomID, encrypted, roomLog)
+
+		var decrypted []*event.Event
+		for _, evt := range encrypted {
+			if evt.Type.Type != event.EventEncrypted.Type {
+				decrypted = append(decrypted, evt)
+			}
+		}
+		if len(decrypted) == 0 {
+			continue
+		}
+		roomLog.Debug().Str("day", day).Int("count", len(decrypted)).Msg("Decrypted stored events")
+		if err := processEvents(ctx, store, roomDirName, decrypted); err != nil {
+			return totalDecrypted, totalFailed, err
+		}
+		totalDecrypted += len(decrypted)
+		if media != nil {
+			if err := downloadEventMedia(ctx, client, media, roomDirName, decrypted, roomLog); err != nil {
+				return totalDecrypted, totalFailed, err
+			}
+		}
+	}
+	return totalDecrypted, totalFailed, finishRoom(ctx, store, roomDirName)
+}
+
+// redecryptBackup walks all room directories in the backup directory and
+// decrypts the stored events which could not be decrypted before.
+func redecryptBackup(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) error {
+	if client.Crypto == nil {
+		return errRedecryptWithoutE2EE
+	}
+	store, err := openStorage(ctx, cli)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(store, logger)
+	roomDirNames, err := store.ListRooms(ctx)
+	if err != nil {
+		return err
+	}
+	var media *mediaStore
+	if cli.Media {
+		if media, err = openMediaStore(store); err != nil {
+			return err
+		}
+	}
+
+	var redecryptErrors []string
+	totalDecrypted, totalFailed := 0, 0
+	for _, dirName := range roomDirNames {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		roomID, ok := roomIDFromDirName(dirName)
+		if !ok {
+			continue
+		}
+		roomLog := logger.With().Str("room_id", roomID.String()).Str("room_dir", dirName).Logger()
+		decrypted, failed, err := redecryptRoom(roomLog.WithContext(ctx), client, roomID, store, dirName, media, roomLog)
+		totalDecrypted += decrypted
+		totalFailed += failed
+		if err != nil {
+			roomLog.Error().Err(err).Msg("Failed to re-decrypt room")
+			redecryptErrors = append(redecryptErrors, fmt.Sprintf("room %s: %v", roomID, err))
+			continue
+		}
+		if decrypted > 0 || failed > 0 {
+			roomLog.Info().Int("decrypted", decrypted).Int("failed", failed).Msg("Re-decrypted room")
+		}
+	}
+	logger.Info().Int("decrypted", totalDecrypted).Int("failed", totalFailed).Msg("Re-decryption finished")
+
+	if len(redecryptErrors) > 0 {
+		return errors.New("encountered errors during re-decryption: " + strings.Join(redecryptErrors, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/crypto/goolm/session"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestRedecryptBackup(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	machine := newTestCryptoMachine(t, backupDir)
+	outbound, err := session.NewMegolmOutboundSession()
+	assert.NilError(t, err)
+	sessionKey := outbound.Key()
+
+	// Store the events before we have the room key
+	roomDirName := "Room:" + testRoomID.String()
+	events := []*event.Event{
+		newTestEvent("$plain", 1, "plain"),
+		newTestEncryptedEvent(t, outbound, "$encrypted", 2, "late key"),
+	}
+	assert.Equal(t, decryptEvents(ctx, machine, testRoomID, events, zerolog.Nop()), 1)
+	assert.NilError(t, processEvents(ctx, store, roomDirName, events))
+
+	cli := &CLI{BackupDir: backupDir}
+	machine.client.Crypto = machine
+	assert.NilError(t, redecryptBackup(ctx, machine.client, cli, zerolog.Nop()))
+	stored, err := store.ReadDay(ctx, roomDirName, "1970-01-01")
+	assert.NilError(t, err)
+	assert.Equal(t, stored[1].Type.Type, event.EventEncrypted.Type)
+
+	addTestRoomKey(t, machine, testRoomID, sessionKey)
+	assert.NilError(t, redecryptBackup(ctx, machine.client, cli, zerolog.Nop()))
+	stored, err = store.ReadDay(ctx, roomDirName, "1970-01-01")
+	assert.NilError(t, err)
+	assert.Equal(t, len(stored), 2)
+	assert.Equal(t, stored[0].Content.Raw["body"], "plain")
+	assert.Equal(t, stored[1].Type.Type, event.EventMessage.Type)
+	assert.Equal(t, stored[1].Content.Raw["body"], "late key")
+	original, ok := stored[1].Content.Raw[encryptedContentKey].(map[string]any)
+	assert.Assert(t, ok)
+	assert.Assert(t, original[decryptionErrorKey] == nil)
+
+	t.Run("Without E2EE", func(t *testing.T) {
+		machine.client.Crypto = nil
+		err := redecryptBackup(ctx, machine.client, cli, zerolog.Nop())
+		assert.ErrorIs(t, err, errRedecryptWithoutE2EE)
+	})
+}
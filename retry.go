@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+)
+
+const (
+	retryBaseDelay = 1 * time.Second // Delay before the first retry, doubled for each following one
+	retryMaxDelay  = 1 * time.Minute
+)
+
+// retryPolicy decides how many times failed requests are retried, and how
+// long to wait before each retry.
+type retryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// delay returns the time to wait before the retry following the given number
+// of failed attempts: the delay asked by the server if any, and otherwise an
+// exponential backoff with jitter.
+func (self retryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	backoff := self.MaxDelay
+	if attempt < 32 {
+		backoff = min(self.BaseDelay<<attempt, self.MaxDelay)
+	}
+	// Half of the backoff is randomized, so that parallel workers spread out
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// isRetryableStatus checks whether the HTTP status is a temporary server
+// error or a rate limit. Other 4xx client errors are not retryable.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// isRetryableError checks whether the request error is a temporary network
+// or server error, which may succeed if retried.
+func isRetryableError(err error) bool {
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Response != nil {
+		return isRetryableStatus(httpErr.Response.StatusCode)
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	errString := strings.ToLower(err.Error())
+	return strings.Contains(errString, "timed out") || strings.Contains(errString, "connection refused") ||
+		strings.Contains(errString, "no such host") || strings.Contains(errString, "network is unreachable")
+}
+
+// isIdempotentMethod checks whether requests with the HTTP method can be
+// repeated without changing their effect.
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConnectError checks whether the request error happened while connecting
+// to the server, i.e. before anything was sent.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// retryAfterDelay returns the delay asked by the server in a rate limited
+// response: retry_after_ms of a M_LIMIT_EXCEEDED error, or the Retry-After
+// header (in seconds).
+func retryAfterDelay(resp *http.Response, body []byte) time.Duration {
+	var respErr struct {
+		RetryAfterMs int64 `json:"retry_after_ms"`
+	}
+	if json.Unmarshal(body, &respErr) == nil && respErr.RetryAfterMs > 0 {
+		return time.Duration(respErr.RetryAfterMs) * time.Millisecond
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// retryTransport is a http.RoundTripper which retries the requests failing
+// with temporary errors according to the retry policy. Requests with methods
+// which are not idempotent (e.g. POST) are retried only on rate limits and on
+// connection errors, as the server may have processed them otherwise.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy retryPolicy
+	logger zerolog.Logger
+}
+
+func (self *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	idempotent := isIdempotentMethod(req.Method)
+	for attempt := 0; ; attempt++ {
+		resp, err := self.base.RoundTrip(req)
+		if attempt >= self.policy.MaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		var retryAfter time.Duration
+		if err == nil {
+			if !isRetryableStatus(resp.StatusCode) || (!idempotent && resp.StatusCode != http.StatusTooManyRequests) {
+				return resp, nil
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				body, readErr := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				resp.Body = io.NopCloser(bytes.NewReader(body))
+				if readErr != nil {
+					return resp, nil
+				}
+				retryAfter = retryAfterDelay(resp, body)
+			}
+		} else if !isRetryableError(err) || (!idempotent && !isConnectError(err)) {
+			return resp, err
+		}
+
+		// The request body has been consumed, so it has to be recreated
+		retryReq := req.Clone(ctx)
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			retryReq.Body = body
+		}
+		delay := self.policy.delay(attempt, retryAfter)
+		logEvent := self.logger.Warn().Err(err).Str("path", req.URL.Path).Int("attempt", attempt+1).Dur("retry_delay", delay)
+		if resp != nil {
+			logEvent.Int("status_code", resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logEvent.Msg("Request failed, retrying after delay")
+		sleepContext(ctx, delay)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		req = retryReq
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{MaxRetries: 5, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, maxDelay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := policy.delay(attempt, 0)
+		assert.Assert(t, delay >= maxDelay/2 && delay <= maxDelay, "attempt %d: %v", attempt, delay)
+	}
+	assert.Equal(t, policy.delay(100, 0) <= policy.MaxDelay, true)
+	assert.Equal(t, policy.delay(0, time.Minute), time.Minute)
+}
+
+func TestIsRetryableError(t *testing.T) {
+	assert.Assert(t, isRetryableError(io.EOF))
+	assert.Assert(t, isRetryableError(syscall.ECONNREFUSED))
+	assert.Assert(t, isRetryableError(mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusBadGateway}}))
+	assert.Assert(t, isRetryableError(mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusTooManyRequests}}))
+	assert.Assert(t, !isRetryableError(mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusForbidden}}))
+	assert.Assert(t, !isRetryableError(context.Canceled))
+	assert.Assert(t, !isRetryableError(errors.New("invalid character")))
+
+	assert.Assert(t, isConnectError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	assert.Assert(t, isConnectError(&net.DNSError{Err: "no such host"}))
+	assert.Assert(t, !isConnectError(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+}
+
+func TestRetryTransport(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Check(t, string(body) == "request")
+		switch requests.Add(1) {
+		case 1:
+			mautrix.MLimitExceeded.WithMessage("Too many requests").Write(w)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := &http.Client{Transport: &retryTransport{
+		base:   http.DefaultTransport,
+		policy: retryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		logger: zerolog.Nop(),
+	}}
+
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("request"))
+	assert.NilError(t, err)
+	resp, err := client.Do(req)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "ok")
+	assert.Equal(t, requests.Load(), int32(3))
+
+	// POST requests are retried after a rate limit, but not after a server error
+	requests.Store(0)
+	resp, err = client.Post(server.URL, "text/plain", strings.NewReader("request"))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadGateway)
+	assert.Equal(t, requests.Load(), int32(2))
+
+	assert.Equal(t, retryAfterDelay(&http.Response{}, []byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1500}`)), 1500*time.Millisecond)
+	assert.Equal(t, retryAfterDelay(&http.Response{Header: http.Header{"Retry-After": []string{"2"}}}, nil), 2*time.Second)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// otherRoomsSyncFilter includes the left rooms in the sync, with only our
+// membership event (the last member event before leaving) in their timeline.
+const otherRoomsSyncFilter = `{"room":{"include_leave":true,"timeline":{"limit":1,"types":["m.room.member"]},"state":{"types":[]},"ephemeral":{"types":[]},"account_data":{"types":[]}},"presence":{"types":[]},"account_data":{"types":[]}}`
+
+// roomMembership is a room to back up, with our membership in it. The
+// membership is empty for rooms found only through room upgrade links.
+type roomMembership struct {
+	RoomID     id.RoomID
+	Membership event.Membership
+}
+
+// leftRoomMembership tells whether we left or were banned from (or kicked out of) the room.
+func leftRoomMembership(userID id.UserID, leftRoom *mautrix.SyncLeftRoom) event.Membership {
+	for _, evt := range leftRoom.Timeline.Events {
+		if evt.Type.Type != event.StateMember.Type || evt.GetStateKey() != userID.String() {
+			continue
+		}
+		if membership, ok := evt.Content.Raw["membership"].(string); ok && event.Membership(membership) == event.MembershipBan {
+			return event.MembershipBan
+		}
+	}
+	return event.MembershipLeave
+}
+
+// discoverOtherRooms finds the rooms we have left (or been banned from) and
+// the rooms we are invited to, using a sync which includes left rooms.
+func discoverOtherRooms(ctx context.Context, client *mautrix.Client) ([]roomMembership, error) {
+	resp, err := client.FullSyncRequest(ctx, mautrix.ReqSync{FilterID: otherRoomsSyncFilter})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync left rooms: %w", err)
+	}
+	rooms := make([]roomMembership, 0, len(resp.Rooms.Leave)+len(resp.Rooms.Invite))
+	for roomID, leftRoom := range resp.Rooms.Leave {
+		rooms = append(rooms, roomMembership{RoomID: roomID, Membership: leftRoomMembership(client.UserID, leftRoom)})
+	}
+	for roomID := range resp.Rooms.Invite {
+		rooms = append(rooms, roomMembership{RoomID: roomID, Membership: event.MembershipInvite})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms, nil
+}
+
+// isUnreadableRoom tells whether the error is due to the room (history) not
+// being readable anymore, which is expected for rooms we are not joined to.
+func isUnreadableRoom(room roomMembership, err error) bool {
+	return room.Membership != event.MembershipJoin && errors.Is(err, mautrix.MForbidden)
+}
+
+// findRoomDirName finds an existing directory for the room in the backup.
+func findRoomDirName(ctx context.Context, store backupStorage, roomID id.RoomID) (string, bool) {
+	roomDirNames, err := store.ListRooms(ctx)
+	if err != nil {
+		return "", false
+	}
+	for _, dirName := range roomDirNames {
+		if extractedRoomID, ok := roomIDFromDirName(dirName); ok && extractedRoomID == roomID {
+			return dirName, true
+		}
+	}
+	return "", false
+}
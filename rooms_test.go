@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestMemberEvent(userID string, membership event.Membership) map[string]any {
+	return map[string]any{
+		"type": "m.room.member", "state_key": userID, "event_id": "$member", "sender": "@admin:example.org",
+		"content": map[string]any{"membership": membership},
+	}
+}
+
+func TestDiscoverOtherRooms(t *testing.T) {
+	server, _ := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/sync": map[string]any{
+			"next_batch": "batch",
+			"rooms": map[string]any{
+				"leave": map[string]any{
+					"!left:example.org": map[string]any{"timeline": map[string]any{"events": []any{
+						newTestMemberEvent("@user:example.org", event.MembershipLeave),
+					}}},
+					"!banned:example.org": map[string]any{"timeline": map[string]any{"events": []any{
+						newTestMemberEvent("@other:example.org", event.MembershipLeave),
+						newTestMemberEvent("@user:example.org", event.MembershipBan),
+					}}},
+				},
+				"invite": map[string]any{
+					"!invited:example.org": map[string]any{"invite_state": map[string]any{"events": []any{}}},
+				},
+			},
+		},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+
+	rooms, err := discoverOtherRooms(context.Background(), client)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rooms, []roomMembership{
+		{RoomID: "!banned:example.org", Membership: event.MembershipBan},
+		{RoomID: "!invited:example.org", Membership: event.MembershipInvite},
+		{RoomID: "!left:example.org", Membership: event.MembershipLeave},
+	})
+}
+
+func TestFindRoomDirName(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	assert.NilError(t, os.Mkdir(filepath.Join(backupDir, "Old name:"+testRoomID.String()), 0o755))
+
+	dirName, ok := findRoomDirName(ctx, store, testRoomID)
+	assert.Assert(t, ok)
+	assert.Equal(t, dirName, "Old name:"+testRoomID.String())
+
+	_, ok = findRoomDirName(ctx, store, id.RoomID("!other:example.org"))
+	assert.Assert(t, !ok)
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	_ "modernc.org/sqlite" // Registers the sqlite driver
+)
+
+// sqliteDriverName is the database/sql driver of the crypto store and of the
+// SQLite storage, the pure Go modernc.org/sqlite.
+const sqliteDriverName = "sqlite"
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	stateFilePrefix = "state-"
+	stateTimeFormat = "2006-01-02T150405Z"
+)
+
+// isStateFile checks whether the file name is that of a room state snapshot
+// (state-yyyy-mm-ddThhmmssZ.json).
+func isStateFile(name string) bool {
+	stateTime, ok := strings.CutPrefix(name, stateFilePrefix)
+	if !ok {
+		return false
+	}
+	if stateTime, ok = strings.CutSuffix(stateTime, ".json"); !ok {
+		return false
+	}
+	_, err := time.Parse(stateTimeFormat, stateTime)
+	return err == nil
+}
+
+// fetchRoomState gets the full current state of the room, sorted by type and state key.
+func fetchRoomState(ctx context.Context, client *mautrix.Client, roomID id.RoomID) ([]*event.Event, error) {
+	var stateEvents []*event.Event
+	_, err := client.MakeRequest(ctx, http.MethodGet, client.BuildClientURL("v3", "rooms", roomID, "state"), nil, &stateEvents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch room state: %w", err)
+	}
+	sort.SliceStable(stateEvents, func(i, j int) bool {
+		if stateEvents[i].Type.Type != stateEvents[j].Type.Type {
+			return stateEvents[i].Type.Type < stateEvents[j].Type.Type
+		}
+		return stateEvents[i].GetStateKey() < stateEvents[j].GetStateKey()
+	})
+	return stateEvents, nil
+}
+
+// latestStateFile returns the name of the newest state snapshot of the room, if any.
+func latestStateFile(ctx context.Context, store backupStorage, roomDirName string) (string, error) {
+	names, err := store.ListRoomFiles(ctx, roomDirName)
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, name := range names {
+		// The time format sorts chronologically
+		if isStateFile(name) && name > latest {
+			latest = name
+		}
+	}
+	return latest, nil
+}
+
+// writeStateSnapshot writes the room state as the snapshot of the given time,
+// unless it is identical to the latest snapshot. Returns whether it was written.
+func writeStateSnapshot(ctx context.Context, store backupStorage, roomDirName string, stateEvents []*event.Event, now time.Time) (bool, error) {
+	data, err := json.MarshalIndent(stateEvents, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal room state: %w", err)
+	}
+	latest, err := latestStateFile(ctx, store, roomDirName)
+	if err != nil {
+		return false, err
+	}
+	if latest != "" {
+		latestData, err := store.ReadRoomFile(ctx, roomDirName, latest)
+		if err != nil {
+			return false, fmt.Errorf("failed to read state snapshot %s: %w", latest, err)
+		}
+		if bytes.Equal(latestData, data) {
+			return false, nil
+		}
+	}
+
+	stateName := stateFilePrefix + now.UTC().Format(stateTimeFormat) + ".json"
+	if err := store.WriteRoomFile(ctx, roomDirName, stateName, data); err != nil {
+		return false, fmt.Errorf("failed to write state snapshot %s: %w", stateName, err)
+	}
+	return true, nil
+}
+
+// backupRoomState saves a snapshot of the current room state, and downloads
+// the media it references (e.g. avatars) unless media is nil. Returns the state events.
+func backupRoomState(ctx context.Context, client *mautrix.Client, roomID id.RoomID, store backupStorage, roomDirName string, media *mediaStore, roomLog zerolog.Logger) ([]*event.Event, error) {
+	stateEvents, err := fetchRoomState(ctx, client, roomID)
+	if err != nil {
+		return nil, err
+	}
+	written, err := writeStateSnapshot(ctx, store, roomDirName, stateEvents, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	roomLog.Debug().Int("count", len(stateEvents)).Bool("changed", written).Msg("Backed up room state")
+	if media != nil {
+		if err := downloadEventMedia(ctx, client, media, roomDirName, stateEvents, roomLog); err != nil {
+			return nil, err
+		}
+	}
+	return stateEvents, nil
+}
+
+// mergeStateSnapshots copies the state snapshots of an old room directory to
+// the target room directory, unless it has a snapshot with the same name.
+func mergeStateSnapshots(ctx context.Context, store backupStorage, oldDirName, targetDirName string) error {
+	names, err := store.ListRoomFiles(ctx, oldDirName)
+	if err != nil {
+		return err
+	}
+	targetNames, err := store.ListRoomFiles(ctx, targetDirName)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !isStateFile(name) || slices.Contains(targetNames, name) {
+			continue
+		}
+		if err := copyRoomFile(ctx, store, oldDirName, targetDirName, name); err != nil {
+			return fmt.Errorf("failed to move state snapshot %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+const testRoomStatePath = "/_matrix/client/v3/rooms/!room:example.org/state"
+
+func newTestStateEvents(topic string) []map[string]any {
+	return []map[string]any{
+		{"type": "m.room.topic", "state_key": "", "event_id": "$topic", "content": map[string]any{"topic": topic}},
+		{"type": "m.room.member", "state_key": "@user:example.org", "event_id": "$member", "content": map[string]any{"membership": "join", "avatar_url": testMediaURI}},
+		{"type": "m.room.create", "state_key": "", "event_id": "$create", "content": map[string]any{}},
+	}
+}
+
+func TestWriteStateSnapshot(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	roomDirName := "Room:" + testRoomID.String()
+	day1 := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	later := day1.Add(time.Hour)
+	stateEvents := []*event.Event{newTestEvent("$state", 1, "state")}
+
+	written, err := writeStateSnapshot(ctx, store, roomDirName, stateEvents, day1)
+	assert.NilError(t, err)
+	assert.Assert(t, written)
+	assert.Assert(t, fileExists(filepath.Join(backupDir, roomDirName, "state-2024-01-15T120000Z.json")))
+
+	// Unchanged state is not written again
+	written, err = writeStateSnapshot(ctx, store, roomDirName, stateEvents, later)
+	assert.NilError(t, err)
+	assert.Assert(t, !written)
+
+	stateEvents = append(stateEvents, newTestEvent("$state2", 2, "changed"))
+	// A second change on the same day is kept besides the first one
+	written, err = writeStateSnapshot(ctx, store, roomDirName, stateEvents, later)
+	assert.NilError(t, err)
+	assert.Assert(t, written)
+	latest, err := latestStateFile(ctx, store, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, latest, "state-2024-01-15T130000Z.json")
+	assert.Assert(t, fileExists(filepath.Join(backupDir, roomDirName, "state-2024-01-15T120000Z.json")))
+	assert.Assert(t, !isDayFile(latest))
+	assert.Assert(t, !isStateFile("state-2024-01-15T130000Z.json.zst"))
+}
+
+func TestBackupRoomState(t *testing.T) {
+	ctx := context.Background()
+	media, roomDirName := newTestMediaStore(t)
+	server, _ := newTestHomeserver(t, map[string]any{
+		testRoomStatePath: newTestStateEvents("Topic"),
+		testMediaDownloadPath + "example.org/image": []byte(testMediaContent),
+	})
+	client := newTestServerCryptoMachine(t, server).client
+
+	stateEvents, err := backupRoomState(ctx, client, testRoomID, media.storage, roomDirName, media, zerolog.Nop())
+	assert.NilError(t, err)
+	assert.Equal(t, len(stateEvents), 3)
+	latest, err := latestStateFile(ctx, media.storage, roomDirName)
+	assert.NilError(t, err)
+	data, err := media.storage.ReadRoomFile(ctx, roomDirName, latest)
+	assert.NilError(t, err)
+	var stored []*event.Event
+	assert.NilError(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, len(stored), 3)
+	assert.Equal(t, stored[0].Type.Type, "m.room.create")
+	assert.Equal(t, stored[1].Type.Type, "m.room.member")
+	assert.Equal(t, stored[2].Content.Raw["topic"], "Topic")
+	assert.Equal(t, readRoomMedia(t, media, roomDirName, testMediaURI), testMediaContent)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	storageFile   = "file"
+	storageSQLite = "sqlite"
+)
+
+var (
+	errCorruptDay     = errors.New("corrupted day file")
+	errUnknownStorage = errors.New("unknown storage backend")
+)
+
+// backupStorage keeps the backed up data: the events of the rooms grouped by
+// day, the metadata of the rooms, the other files of the rooms (state
+// snapshots, media indexes, quarantined and legacy files), the media blobs
+// with the references to them, and the other files of the backup (the sync
+// position). Rooms are given by the names of their directories in the backup
+// (sanitizedName:roomID), which backends not using the filesystem use as keys.
+type backupStorage interface {
+	// ListRooms returns the directory names of the stored rooms.
+	ListRooms(ctx context.Context) ([]string, error)
+	// RemoveRoom removes all data of the room.
+	RemoveRoom(ctx context.Context, room string) error
+
+	// ReadMetadata returns the metadata of the room, which is empty if the room has none.
+	ReadMetadata(ctx context.Context, room string) (*Metadata, error)
+	WriteMetadata(ctx context.Context, room string, meta *Metadata) error
+
+	// ListDays returns the days (yyyy-mm-dd) with stored events in the room, in order.
+	ListDays(ctx context.Context, room string) ([]string, error)
+	// ReadDay returns the stored events of the day, or nil if there are none.
+	// The error wraps errCorruptDay if the stored events cannot be read.
+	ReadDay(ctx context.Context, room, day string) ([]*event.Event, error)
+	// WriteDay replaces the stored events of the day.
+	WriteDay(ctx context.Context, room, day string, events []*event.Event) error
+	// StoreEvents merges the events into the stored days, and then writes the
+	// metadata unless it is nil. Events are unique by EventID within their day,
+	// and preferredEvent picks which version is kept. The metadata is committed
+	// together with the events or after them, so that its tokens never point
+	// past stored events.
+	StoreEvents(ctx context.Context, room string, events []*event.Event, meta *Metadata) error
+	// QuarantineDay moves the stored events of the day aside to a room file
+	// (see isQuarantinedFile), so that they are kept for manual recovery.
+	// Returns the new location.
+	QuarantineDay(ctx context.Context, room, day string) (string, error)
+
+	// ListRoomFiles returns the names of the other files of the room, in order.
+	ListRoomFiles(ctx context.Context, room string) ([]string, error)
+	// ReadRoomFile returns the content of the room file, or nil if there is no such file.
+	ReadRoomFile(ctx context.Context, room, name string) ([]byte, error)
+	// WriteRoomFile replaces the content of the room file.
+	WriteRoomFile(ctx context.Context, room, name string, data []byte) error
+
+	// HasBlob checks whether the media blob with the content hash is stored.
+	HasBlob(ctx context.Context, hash string) (bool, error)
+	// PutBlob moves the complete file at path to the blob with the content hash.
+	PutBlob(ctx context.Context, hash, path string) error
+	// MediaHash returns the content hash of the stored media of the mxc://
+	// URI, or "" if it has not been stored.
+	MediaHash(ctx context.Context, uri id.ContentURIString) (string, error)
+	// AddMedia records the content hash of the stored media of the URI.
+	AddMedia(ctx context.Context, uri id.ContentURIString, hash string) error
+	// TempDir returns the local directory for the downloaded files, before
+	// PutBlob moves them to the storage.
+	TempDir() string
+
+	// ReadFile returns the content of the file of the backup, outside the
+	// rooms, or nil if there is no such file.
+	ReadFile(ctx context.Context, name string) ([]byte, error)
+	// WriteFile replaces the content of the file of the backup.
+	WriteFile(ctx context.Context, name string, data []byte) error
+}
+
+// roomFinisher is implemented by storages which defer work on the stored
+// events of a room until the backup of the room is finished.
+type roomFinisher interface {
+	FinishRoom(ctx context.Context, room string) error
+}
+
+// finishRoom lets the storage finish the work on the stored events of the room.
+func finishRoom(ctx context.Context, store backupStorage, room string) error {
+	if finisher, ok := store.(roomFinisher); ok {
+		return finisher.FinishRoom(ctx, room)
+	}
+	return nil
+}
+
+// closeStorage releases the resources held by the storage, if it has any.
+func closeStorage(store backupStorage, logger zerolog.Logger) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Warn().Err(err).Msg("Failed to close storage")
+		}
+	}
+}
+
+// fileStorage is the default storage, with a directory per room in the backup
+// directory holding a JSON file per day and the metadata file, and the media
+// blobs in the media directory. Day files are written with the compression,
+// and read with any compression.
+type fileStorage struct {
+	dir         string
+	compression string
+
+	mediaLock   sync.Mutex
+	mediaHashes map[id.ContentURIString]string // The media index, once read
+}
+
+func newFileStorage(backupDir string) *fileStorage {
+	return &fileStorage{dir: backupDir}
+}
+
+// dayFileStorage is a storage keeping the days in files in the room
+// directories, whose day files can be converted to its format.
+type dayFileStorage interface {
+	backupStorage
+	// dayPath returns the path the day is written to.
+	dayPath(room, day string) string
+	existingDayPaths(room, day string) []string
+}
+
+// openDayFileStorage opens the file storage with the day format and the
+// compression selected by the options.
+func openDayFileStorage(cli *CLI) dayFileStorage {
+	store := newFileStorage(cli.BackupDir)
+	store.compression = cli.Compress
+	if cli.DayFormat == dayFormatJSONL {
+		return newJSONLStorage(store)
+	}
+	return store
+}
+
+// openStorage opens the storage selected by the options.
+func openStorage(ctx context.Context, cli *CLI) (backupStorage, error) {
+	switch cli.Storage {
+	case "", storageFile:
+		return openDayFileStorage(cli), nil
+	case storageSQLite:
+		return openSQLiteStorage(ctx, cli.BackupDir)
+	case storageS3:
+		return openS3Storage(ctx, cli)
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownStorage, cli.Storage)
+}
+
+// roomPath returns the path of the directory of the room.
+func (self *fileStorage) roomPath(room string) string {
+	return filepath.Join(self.dir, room)
+}
+
+// createRoomDir creates the directory of the room, if it does not exist yet.
+func (self *fileStorage) createRoomDir(room string) error {
+	if err := os.MkdirAll(self.roomPath(room), 0o755); err != nil {
+		return fmt.Errorf("failed to create room directory %s: %w", self.roomPath(room), err)
+	}
+	return nil
+}
+
+func (self *fileStorage) ListRooms(context.Context) ([]string, error) {
+	dirEntries, err := os.ReadDir(self.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory %s: %w", self.dir, err)
+	}
+	var rooms []string
+	for _, entry := range dirEntries {
+		if _, ok := roomIDFromDirName(entry.Name()); ok && entry.IsDir() {
+			rooms = append(rooms, entry.Name())
+		}
+	}
+	return rooms, nil
+}
+
+func (self *fileStorage) RemoveRoom(_ context.Context, room string) error {
+	if err := os.RemoveAll(self.roomPath(room)); err != nil {
+		return fmt.Errorf("failed to remove room directory %s: %w", self.roomPath(room), err)
+	}
+	return nil
+}
+
+func (self *fileStorage) ReadMetadata(_ context.Context, room string) (*Metadata, error) {
+	metaPath := filepath.Join(self.roomPath(room), metadataFilename)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Metadata{}, nil // Return empty metadata if file doesn't exist
+		}
+		return nil, fmt.Errorf("failed to read metadata file %s: %w", metaPath, err)
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata file %s: %w", metaPath, err)
+	}
+	return &meta, nil
+}
+
+func (self *fileStorage) WriteMetadata(_ context.Context, room string, meta *Metadata) error {
+	metaPath := filepath.Join(self.roomPath(room), metadataFilename)
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if err := self.createRoomDir(room); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(metaPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write metadata file %s: %w", metaPath, err)
+	}
+	return nil
+}
+
+// StoreEvents rewrites the days of the events, and then replaces the metadata
+// file.
+func (self *fileStorage) StoreEvents(ctx context.Context, room string, events []*event.Event, meta *Metadata) error {
+	if err := mergeDays(ctx, self, room, events); err != nil {
+		return err
+	}
+	if meta == nil {
+		return nil
+	}
+	return self.WriteMetadata(ctx, room, meta)
+}
+
+// isDayFile checks whether the file name is that of a daily event file
+// (yyyy-mm-dd.json, optionally compressed).
+func isDayFile(name string) bool {
+	_, _, ok := parseDayFileName(name)
+	return ok
+}
+
+// dayPath returns the path the day is written to.
+func (self *fileStorage) dayPath(room, day string) string {
+	return filepath.Join(self.roomPath(room), day+".json"+compressionExtensions[self.compression])
+}
+
+// existingDayPaths returns the paths of the existing files of the day. There
+// is more than one only if writing the day with another compression or format
+// was interrupted.
+func (self *fileStorage) existingDayPaths(room, day string) []string {
+	var paths []string
+	for _, compression := range compressions {
+		if dataPath := filepath.Join(self.roomPath(room), day+".json"+compressionExtensions[compression]); fileExists(dataPath) {
+			paths = append(paths, dataPath)
+		}
+	}
+	if dataPath := filepath.Join(self.roomPath(room), day+jsonlExtension); fileExists(dataPath) {
+		paths = append(paths, dataPath)
+	}
+	return paths
+}
+
+func (self *fileStorage) ListDays(_ context.Context, room string) ([]string, error) {
+	files, err := os.ReadDir(self.roomPath(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read room directory %s: %w", self.roomPath(room), err)
+	}
+	var days []string
+	for _, file := range files {
+		if day, _, ok := parseDayFileName(file.Name()); ok && !file.IsDir() {
+			days = append(days, day)
+		}
+	}
+	// The date format sorts chronologically
+	sort.Strings(days)
+	return slices.Compact(days), nil
+}
+
+// readDayFile reads the events of a day file.
+func readDayFile(dataPath string) ([]*event.Event, error) {
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data file %s: %w", dataPath, err)
+	}
+	_, compression, _ := parseDayFileName(filepath.Base(dataPath))
+	if data, err = decompressData(compression, data); err != nil {
+		return nil, fmt.Errorf("%w %s: %w", errCorruptDay, dataPath, err)
+	}
+	if strings.HasSuffix(dataPath, jsonlExtension) {
+		return parseJSONLEvents(dataPath, data)
+	}
+	var events []*event.Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("%w %s: %w", errCorruptDay, dataPath, err)
+	}
+	return events, nil
+}
+
+func (self *fileStorage) ReadDay(_ context.Context, room, day string) ([]*event.Event, error) {
+	var events []*event.Event
+	for i, dataPath := range self.existingDayPaths(room, day) {
+		fileEvents, err := readDayFile(dataPath)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			events = fileEvents
+		} else {
+			events = mergeDayEvents(events, fileEvents)
+		}
+	}
+	return events, nil
+}
+
+func (self *fileStorage) WriteDay(_ context.Context, room, day string, events []*event.Event) error {
+	dataPath := self.dayPath(room, day)
+	// Ensure the room directory exists before writing the file
+	if err := self.createRoomDir(room); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal events for date %s: %w", day, err)
+	}
+	if data, err = compressData(self.compression, data); err != nil {
+		return fmt.Errorf("failed to compress events for date %s: %w", day, err)
+	}
+	if err := writeFileAtomic(dataPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write data file %s: %w", dataPath, err)
+	}
+	// The files of the day with other compressions are merged in now
+	return removeFiles(slices.DeleteFunc(self.existingDayPaths(room, day), func(path string) bool {
+		return path == dataPath
+	}))
+}
+
+func (self *fileStorage) QuarantineDay(_ context.Context, room, day string) (string, error) {
+	var quarantinePaths []string
+	for _, dataPath := range self.existingDayPaths(room, day) {
+		quarantinePath, err := quarantineFile(dataPath, self.roomPath(room))
+		if err != nil {
+			return "", err
+		}
+		quarantinePaths = append(quarantinePaths, quarantinePath)
+	}
+	return strings.Join(quarantinePaths, ", "), nil
+}
+
+// ListRoomFiles returns the files of the room directory other than the day
+// files and the metadata file, skipping the temporary files of interrupted writes.
+func (self *fileStorage) ListRoomFiles(_ context.Context, room string) ([]string, error) {
+	files, err := os.ReadDir(self.roomPath(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read room directory %s: %w", self.roomPath(room), err)
+	}
+	var names []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || isDayFile(name) || name == metadataFilename || strings.HasPrefix(name, ".") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (self *fileStorage) ReadRoomFile(_ context.Context, room, name string) ([]byte, error) {
+	filePath := filepath.Join(self.roomPath(room), name)
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+	return data, nil
+}
+
+func (self *fileStorage) WriteRoomFile(_ context.Context, room, name string, data []byte) error {
+	if err := self.createRoomDir(room); err != nil {
+		return err
+	}
+	filePath := filepath.Join(self.roomPath(room), name)
+	if err := writeFileAtomic(filePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+	return nil
+}
+
+func (self *fileStorage) blobPath(hash string) string {
+	return filepath.Join(self.dir, mediaDirName, filepath.FromSlash(blobRelPath(hash)))
+}
+
+func (self *fileStorage) HasBlob(_ context.Context, hash string) (bool, error) {
+	blobPath := self.blobPath(hash)
+	if _, err := os.Stat(blobPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check media file %s: %w", blobPath, err)
+	}
+	return true, nil
+}
+
+func (self *fileStorage) PutBlob(_ context.Context, hash, path string) error {
+	blobPath := self.blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create media store directory: %w", err)
+	}
+	if err := os.Rename(path, blobPath); err != nil {
+		return fmt.Errorf("failed to move media file to %s: %w", blobPath, err)
+	}
+	return nil
+}
+
+// mediaIndex returns the media index, reading it on first use. The index is
+// an append-only JSONL file mapping the URIs to the hashes. The caller must
+// hold the media lock.
+func (self *fileStorage) mediaIndex() (map[id.ContentURIString]string, error) {
+	if self.mediaHashes != nil {
+		return self.mediaHashes, nil
+	}
+	hashes := make(map[id.ContentURIString]string)
+	indexPath := filepath.Join(self.dir, mediaDirName, mediaStoreIndexFilename)
+	data, err := readLinesForAppend(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read media store index %s: %w", indexPath, err)
+	}
+	for line := range bytes.Lines(data) {
+		var entry mediaStoreEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.URI == "" || len(entry.SHA256) != sha256.Size*2 {
+			continue
+		}
+		hashes[entry.URI] = entry.SHA256
+	}
+	self.mediaHashes = hashes
+	return hashes, nil
+}
+
+func (self *fileStorage) MediaHash(_ context.Context, uri id.ContentURIString) (string, error) {
+	self.mediaLock.Lock()
+	defer self.mediaLock.Unlock()
+	hashes, err := self.mediaIndex()
+	if err != nil {
+		return "", err
+	}
+	return hashes[uri], nil
+}
+
+func (self *fileStorage) AddMedia(_ context.Context, uri id.ContentURIString, hash string) error {
+	self.mediaLock.Lock()
+	defer self.mediaLock.Unlock()
+	hashes, err := self.mediaIndex()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(mediaStoreEntry{URI: uri, SHA256: hash})
+	if err != nil {
+		return fmt.Errorf("failed to marshal media store index entry: %w", err)
+	}
+	indexPath := filepath.Join(self.dir, mediaDirName, mediaStoreIndexFilename)
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create media store directory: %w", err)
+	}
+	file, err := os.OpenFile(indexPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open media store index %s: %w", indexPath, err)
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err = errors.Join(err, file.Sync(), file.Close()); err != nil {
+		return fmt.Errorf("failed to write media store index %s: %w", indexPath, err)
+	}
+	hashes[uri] = hash
+	return nil
+}
+
+func (self *fileStorage) TempDir() string {
+	return filepath.Join(self.dir, mediaDirName, mediaStoreTmpDirName)
+}
+
+func (self *fileStorage) ReadFile(_ context.Context, name string) ([]byte, error) {
+	filePath := filepath.Join(self.dir, name)
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+	return data, nil
+}
+
+func (self *fileStorage) WriteFile(_ context.Context, name string, data []byte) error {
+	filePath := filepath.Join(self.dir, name)
+	if err := writeFileAtomic(filePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+	return nil
+}
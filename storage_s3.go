@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	storageS3 = "s3"
+
+	// s3MergeAttempts is how many times merging the events of a day is tried
+	// when the day object is changed concurrently.
+	s3MergeAttempts = 5
+
+	s3MediaRefsDirName = "refs"
+)
+
+var (
+	errS3Config        = errors.New("--storage s3 requires --s3-endpoint and --s3-bucket")
+	errS3BucketMissing = errors.New("bucket does not exist")
+	errS3DayChanged    = errors.New("day object changed concurrently")
+)
+
+// s3Storage keeps the events, the room metadata and files, the media blobs
+// and the other files of the backup in an S3-compatible bucket, using the
+// layout of the backup directory as the object keys
+// (prefix/roomDirName/yyyy-mm-dd.json, prefix/roomDirName/metadata.json,
+// prefix/roomDirName/state-....json, prefix/media/ab/ab12... and
+// prefix/sync.json). The media references are objects holding the content
+// hash (prefix/media/refs/server/mediaID). Days are merged with conditional
+// writes, so that concurrent writers do not lose each other's events. Only
+// the downloads in progress are local, in a temporary directory.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	tmpDir string
+}
+
+// openS3Storage connects to the bucket given by the options.
+func openS3Storage(ctx context.Context, cli *CLI) (*s3Storage, error) {
+	if cli.S3Endpoint == "" || cli.S3Bucket == "" {
+		return nil, errS3Config
+	}
+	client, err := minio.New(cli.S3Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cli.S3AccessKey, cli.S3SecretKey, ""),
+		Secure:       !cli.S3Insecure,
+		Region:       cli.S3Region,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client for %s: %w", cli.S3Endpoint, err)
+	}
+	exists, err := client.BucketExists(ctx, cli.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", cli.S3Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errS3BucketMissing, cli.S3Bucket)
+	}
+	prefix := strings.Trim(cli.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	tmpDir, err := os.MkdirTemp("", "go-matrixbackup-media-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return &s3Storage{client: client, bucket: cli.S3Bucket, prefix: prefix, tmpDir: tmpDir}, nil
+}
+
+// Close removes the temporary directory of the downloads.
+func (self *s3Storage) Close() error {
+	if err := os.RemoveAll(self.tmpDir); err != nil {
+		return fmt.Errorf("failed to remove temporary directory %s: %w", self.tmpDir, err)
+	}
+	return nil
+}
+
+func (self *s3Storage) roomKey(room, name string) string {
+	return self.prefix + room + "/" + name
+}
+
+func (self *s3Storage) dayKey(room, day string) string {
+	return self.roomKey(room, day+".json")
+}
+
+func (self *s3Storage) blobKey(hash string) string {
+	return self.prefix + mediaDirName + "/" + blobRelPath(hash)
+}
+
+// mediaRefKey returns the key of the reference object of the media URI
+// (prefix/media/refs/server/mediaID).
+func (self *s3Storage) mediaRefKey(uri id.ContentURIString) string {
+	return self.prefix + mediaDirName + "/" + s3MediaRefsDirName + "/" + strings.TrimPrefix(string(uri), "mxc://")
+}
+
+// isS3NotFound checks whether the error is about a missing object.
+func isS3NotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == minio.NoSuchKey
+}
+
+// readObject returns the data and the ETag of the object, or nil data if
+// there is no such object.
+func (self *s3Storage) readObject(ctx context.Context, key string) ([]byte, string, error) {
+	object, err := self.client.GetObject(ctx, self.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if isS3NotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	info, err := object.Stat()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	return data, info.ETag, nil
+}
+
+// writeObject stores the data in the object. If ifMatch is not empty, the
+// object is written only if its ETag is still that, or if it is "*", only if
+// there is no such object yet; otherwise the error wraps errS3DayChanged.
+func (self *s3Storage) writeObject(ctx context.Context, key string, data []byte, ifMatch string) error {
+	opts := minio.PutObjectOptions{ContentType: "application/json", DisableMultipart: true}
+	switch ifMatch {
+	case "":
+	case "*":
+		opts.SetMatchETagExcept("*")
+	default:
+		opts.SetMatchETag(ifMatch)
+	}
+	_, err := self.client.PutObject(ctx, self.bucket, key, bytes.NewReader(data), int64(len(data)), opts)
+	if minio.ToErrorResponse(err).Code == minio.PreconditionFailed {
+		return fmt.Errorf("%w: %s", errS3DayChanged, key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write object %s: %w", key, err)
+	}
+	return nil
+}
+
+// listKeys lists the keys (or with recursive unset, also the common prefixes
+// ending in a slash) directly under the prefix.
+func (self *s3Storage) listKeys(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	var keys []string
+	for object := range self.client.ListObjects(ctx, self.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list objects %s: %w", prefix, object.Err)
+		}
+		keys = append(keys, strings.TrimPrefix(object.Key, prefix))
+	}
+	return keys, nil
+}
+
+func (self *s3Storage) ListRooms(ctx context.Context) ([]string, error) {
+	keys, err := self.listKeys(ctx, self.prefix, false)
+	if err != nil {
+		return nil, err
+	}
+	var rooms []string
+	for _, key := range keys {
+		dirName, ok := strings.CutSuffix(key, "/")
+		if _, isRoom := roomIDFromDirName(dirName); ok && isRoom {
+			rooms = append(rooms, dirName)
+		}
+	}
+	return rooms, nil
+}
+
+func (self *s3Storage) RemoveRoom(ctx context.Context, room string) error {
+	roomPrefix := self.roomKey(room, "")
+	keys, err := self.listKeys(ctx, roomPrefix, true)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := self.client.RemoveObject(ctx, self.bucket, roomPrefix+key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to remove object %s: %w", roomPrefix+key, err)
+		}
+	}
+	return nil
+}
+
+func (self *s3Storage) ReadMetadata(ctx context.Context, room string) (*Metadata, error) {
+	key := self.roomKey(room, metadataFilename)
+	data, _, err := self.readObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var meta Metadata
+	if data == nil {
+		return &meta, nil
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata object %s: %w", key, err)
+	}
+	return &meta, nil
+}
+
+func (self *s3Storage) WriteMetadata(ctx context.Context, room string, meta *Metadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return self.writeObject(ctx, self.roomKey(room, metadataFilename), data, "")
+}
+
+func (self *s3Storage) ListDays(ctx context.Context, room string) ([]string, error) {
+	keys, err := self.listKeys(ctx, self.roomKey(room, ""), false)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, key := range keys {
+		// Day objects are not compressed
+		if day, compression, ok := parseDayFileName(key); ok && compression == compressNone {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// readDay returns the events and the ETag of the day object.
+func (self *s3Storage) readDay(ctx context.Context, room, day string) ([]*event.Event, string, error) {
+	key := self.dayKey(room, day)
+	data, etag, err := self.readObject(ctx, key)
+	if err != nil || data == nil {
+		return nil, "", err
+	}
+	var events []*event.Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, "", fmt.Errorf("%w %s: %w", errCorruptDay, key, err)
+	}
+	return events, etag, nil
+}
+
+func (self *s3Storage) ReadDay(ctx context.Context, room, day string) ([]*event.Event, error) {
+	events, _, err := self.readDay(ctx, room, day)
+	return events, err
+}
+
+// writeDay stores the events of the day, conditionally as in writeObject.
+func (self *s3Storage) writeDay(ctx context.Context, room, day string, events []*event.Event, ifMatch string) error {
+	data, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal events for date %s: %w", day, err)
+	}
+	return self.writeObject(ctx, self.dayKey(room, day), data, ifMatch)
+}
+
+func (self *s3Storage) WriteDay(ctx context.Context, room, day string, events []*event.Event) error {
+	return self.writeDay(ctx, room, day, events, "")
+}
+
+// mergeDay merges the events into the day object, writing it only if it has
+// not changed since it was read.
+func (self *s3Storage) mergeDay(ctx context.Context, room, day string, dailyEvents []*event.Event) error {
+	existingEvents, etag, err := self.readDay(ctx, room, day)
+	if errors.Is(err, errCorruptDay) {
+		err = quarantineCorruptDay(ctx, self, room, day, err)
+	}
+	if err != nil {
+		return err
+	}
+	if etag == "" {
+		etag = "*"
+	}
+	return self.writeDay(ctx, room, day, mergeDayEvents(existingEvents, dailyEvents), etag)
+}
+
+// StoreEvents merges the events into the day objects, reading and merging a
+// day again if it was changed concurrently, and then writes the metadata
+// object.
+func (self *s3Storage) StoreEvents(ctx context.Context, room string, events []*event.Event, meta *Metadata) error {
+	for day, dailyEvents := range groupEventsByDay(events) {
+		var err error
+		for attempt := 0; attempt < s3MergeAttempts; attempt++ {
+			if err = self.mergeDay(ctx, room, day, dailyEvents); !errors.Is(err, errS3DayChanged) {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if meta == nil {
+		return nil
+	}
+	return self.WriteMetadata(ctx, room, meta)
+}
+
+func (self *s3Storage) QuarantineDay(ctx context.Context, room, day string) (string, error) {
+	key := self.dayKey(room, day)
+	data, _, err := self.readObject(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	quarantineKey := key + corruptFileSuffix + time.Now().UTC().Format(corruptTimeFormat)
+	if err := self.writeObject(ctx, quarantineKey, data, ""); err != nil {
+		return "", err
+	}
+	if err := self.client.RemoveObject(ctx, self.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return "", fmt.Errorf("failed to remove object %s: %w", key, err)
+	}
+	return quarantineKey, nil
+}
+
+// ListRoomFiles returns the objects of the room other than the days and the
+// metadata.
+func (self *s3Storage) ListRoomFiles(ctx context.Context, room string) ([]string, error) {
+	keys, err := self.listKeys(ctx, self.roomKey(room, ""), false)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") && !isDayFile(key) && key != metadataFilename {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (self *s3Storage) ReadRoomFile(ctx context.Context, room, name string) ([]byte, error) {
+	data, _, err := self.readObject(ctx, self.roomKey(room, name))
+	return data, err
+}
+
+func (self *s3Storage) WriteRoomFile(ctx context.Context, room, name string, data []byte) error {
+	return self.writeObject(ctx, self.roomKey(room, name), data, "")
+}
+
+func (self *s3Storage) HasBlob(ctx context.Context, hash string) (bool, error) {
+	key := self.blobKey(hash)
+	_, err := self.client.StatObject(ctx, self.bucket, key, minio.StatObjectOptions{})
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check object %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (self *s3Storage) PutBlob(ctx context.Context, hash, filePath string) error {
+	key := self.blobKey(hash)
+	if _, err := self.client.FPutObject(ctx, self.bucket, key, filePath, minio.PutObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to upload media file to %s: %w", key, err)
+	}
+	if err := os.Remove(filePath); err != nil {
+		return fmt.Errorf("failed to remove uploaded media file %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// MediaHash reads the reference object of the URI, holding the content hash.
+func (self *s3Storage) MediaHash(ctx context.Context, uri id.ContentURIString) (string, error) {
+	data, _, err := self.readObject(ctx, self.mediaRefKey(uri))
+	return string(data), err
+}
+
+func (self *s3Storage) AddMedia(ctx context.Context, uri id.ContentURIString, hash string) error {
+	return self.writeObject(ctx, self.mediaRefKey(uri), []byte(hash), "")
+}
+
+func (self *s3Storage) TempDir() string {
+	return self.tmpDir
+}
+
+func (self *s3Storage) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := self.readObject(ctx, self.prefix+name)
+	return data, err
+}
+
+func (self *s3Storage) WriteFile(ctx context.Context, name string, data []byte) error {
+	return self.writeObject(ctx, self.prefix+name, data, "")
+}
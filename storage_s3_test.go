@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const testS3Bucket = "backup"
+
+// fakeS3 is an in-process S3-compatible service with a single bucket,
+// implementing only what s3Storage uses. beforePut is called before each
+// object write, with the lock held.
+type fakeS3 struct {
+	lock      sync.Mutex
+	objects   map[string][]byte
+	beforePut func(key string)
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []fakeS3Object
+	CommonPrefixes []fakeS3Prefix
+}
+
+type fakeS3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+type fakeS3Prefix struct {
+	Prefix string
+}
+
+func fakeS3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+func writeFakeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+func (self *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	result := fakeS3ListResult{Name: testS3Bucket, Prefix: prefix, MaxKeys: 1000}
+	prefixes := make(map[string]bool)
+	for key, data := range self.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if before, _, found := strings.Cut(rest, delimiter); delimiter != "" && found {
+			prefixes[prefix+before+delimiter] = true
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Object{Key: key, LastModified: time.Now().UTC().Format(time.RFC3339), ETag: fakeS3ETag(data), Size: len(data)})
+	}
+	for commonPrefix := range prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, fakeS3Prefix{Prefix: commonPrefix})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	sort.Slice(result.CommonPrefixes, func(i, j int) bool { return result.CommonPrefixes[i].Prefix < result.CommonPrefixes[j].Prefix })
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// decodeAWSChunked decodes a body with signed chunks ("size;chunk-signature=...\r\ndata\r\n").
+func decodeAWSChunked(body []byte) ([]byte, error) {
+	var data []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < size+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+func (self *fakeS3) put(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		data, err = decodeAWSChunked(data)
+	}
+	if err != nil {
+		writeFakeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if self.beforePut != nil {
+		self.beforePut(key)
+	}
+	existing, exists := self.objects[key]
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if (ifMatch != "" && (!exists || ifMatch != fakeS3ETag(existing))) || (ifNoneMatch == "*" && exists) {
+		writeFakeS3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	self.objects[key] = data
+	w.Header().Set("ETag", fakeS3ETag(data))
+}
+
+func (self *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testS3Bucket {
+		writeFakeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		self.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		self.put(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(self.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := self.objects[key]
+		if !ok {
+			writeFakeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fakeS3ETag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		writeFakeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// newTestS3Storage opens an s3Storage using the fake service.
+func newTestS3Storage(t *testing.T) (*s3Storage, *fakeS3) {
+	ctx := context.Background()
+	t.Helper()
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	store, err := openS3Storage(ctx, &CLI{
+		BackupDir: t.TempDir(), S3Endpoint: strings.TrimPrefix(server.URL, "http://"), S3Bucket: testS3Bucket,
+		S3Prefix: "matrix/", S3Region: "us-east-1", S3AccessKey: "access", S3SecretKey: "secret", S3Insecure: true,
+	})
+	assert.NilError(t, err)
+	t.Cleanup(func() { assert.NilError(t, store.Close()) })
+	return store, fake
+}
+
+func TestS3Storage(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newTestS3Storage(t)
+	roomDirName := "Room:!room:example.org"
+	day := testBackfillDay.UnixMilli()
+
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "b"), newTestEvent("$a", day, "a")}))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "edited"), newTestEvent("$c", day+86400000, "c")}))
+	assert.NilError(t, store.WriteMetadata(ctx, roomDirName, &Metadata{NextToken: "next"}))
+	assert.Assert(t, fake.objects["matrix/Room:!room:example.org/2024-01-15.json"] != nil)
+
+	rooms, err := store.ListRooms(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rooms, []string{"Room:!room:example.org"})
+	days, err := store.ListDays(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, days, []string{"2024-01-15", "2024-01-16"})
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].ID, id.EventID("$a"))
+	assert.Equal(t, events[1].Content.Raw["body"], "edited")
+	meta, err := store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, meta, &Metadata{NextToken: "next"})
+
+	// Unreadable days are quarantined, not overwritten
+	fake.objects["matrix/Room:!room:example.org/2024-01-16.json"] = []byte("[{")
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$d", day+86400000, "d")}))
+	events, err = store.ReadDay(ctx, roomDirName, "2024-01-16")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, len(fake.objects), 4)
+
+	// The other room files are objects of the room too
+	assert.NilError(t, store.WriteRoomFile(ctx, roomDirName, "state-2024-01-15T120000Z.json", []byte("[]")))
+	names, err := store.ListRoomFiles(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, len(names), 2)
+	assert.Assert(t, isQuarantinedFile(names[0]))
+	assert.Equal(t, names[1], "state-2024-01-15T120000Z.json")
+	data, err := store.ReadRoomFile(ctx, roomDirName, "state-2024-01-15T120000Z.json")
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "[]")
+	data, err = store.ReadRoomFile(ctx, roomDirName, "media.json")
+	assert.NilError(t, err)
+	assert.Assert(t, data == nil)
+
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	assert.NilError(t, os.WriteFile(blobPath, []byte("media"), 0o644))
+	stored, err := store.HasBlob(ctx, "ab12")
+	assert.NilError(t, err)
+	assert.Assert(t, !stored)
+	assert.NilError(t, store.PutBlob(ctx, "ab12", blobPath))
+	stored, err = store.HasBlob(ctx, "ab12")
+	assert.NilError(t, err)
+	assert.Assert(t, stored)
+	assert.Assert(t, !fileExists(blobPath))
+	// Only a missing object is a missing blob, other failures are errors
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = store.HasBlob(canceledCtx, "ab12")
+	assert.Assert(t, err != nil)
+
+	// The media references and the other files of the backup are objects too
+	hash, err := store.MediaHash(ctx, testMediaURI)
+	assert.NilError(t, err)
+	assert.Equal(t, hash, "")
+	assert.NilError(t, store.AddMedia(ctx, testMediaURI, "ab12"))
+	hash, err = store.MediaHash(ctx, testMediaURI)
+	assert.NilError(t, err)
+	assert.Equal(t, hash, "ab12")
+	assert.NilError(t, store.WriteFile(ctx, syncStoreFilename, []byte("{}")))
+	data, err = store.ReadFile(ctx, syncStoreFilename)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "{}")
+	_, ok := fake.objects["matrix/media/refs/example.org/image"]
+	assert.Assert(t, ok)
+	rooms, err = store.ListRooms(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rooms, []string{"Room:!room:example.org"})
+
+	assert.NilError(t, store.RemoveRoom(ctx, roomDirName))
+	rooms, err = store.ListRooms(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rooms), 0)
+
+	// Closing removes the temporary directory of the downloads
+	_, err = os.Stat(store.TempDir())
+	assert.NilError(t, err)
+	assert.NilError(t, store.Close())
+	_, err = os.Stat(store.TempDir())
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestS3StorageConcurrentMerge(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newTestS3Storage(t)
+	roomDirName := "Room:!room:example.org"
+	day := testBackfillDay.UnixMilli()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$a", day, "a")}))
+
+	// Another writer adds an event to the day between the read and the write
+	dayKey := "matrix/Room:!room:example.org/2024-01-15.json"
+	fake.beforePut = func(key string) {
+		if key == dayKey {
+			fake.beforePut = nil
+			fake.objects[key] = []byte(`[{"event_id":"$a","type":"m.room.message","origin_server_ts":` + fmt.Sprint(day) + `,"content":{}},
+				{"event_id":"$other","type":"m.room.message","origin_server_ts":` + fmt.Sprint(day+2) + `,"content":{}}]`)
+		}
+	}
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "b")}))
+
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	var eventIDs []id.EventID
+	for _, evt := range events {
+		eventIDs = append(eventIDs, evt.ID)
+	}
+	assert.DeepEqual(t, eventIDs, []id.EventID{"$a", "$b", "$other"})
+}
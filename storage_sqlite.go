@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const sqliteFilename = "backup.sqlite"
+
+// sqliteSchema creates the tables. Events are unique by their ID within a
+// room, like in the daily files, and indexed by room and day for reading the
+// days, by room and timestamp for the timeline, and by sender. The other files
+// of the rooms (state snapshots, media indexes, quarantined days) are kept
+// whole in room_files, and media maps the mxc:// URIs to the content hashes of
+// the media blobs.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS rooms (
+	dir_name       TEXT PRIMARY KEY,
+	next_token     TEXT NOT NULL DEFAULT '',
+	backfill_token TEXT NOT NULL DEFAULT '',
+	membership     TEXT NOT NULL DEFAULT '',
+	predecessor    TEXT NOT NULL DEFAULT '',
+	successor      TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS events (
+	room      TEXT NOT NULL,
+	event_id  TEXT NOT NULL,
+	day       TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	sender    TEXT NOT NULL,
+	type      TEXT NOT NULL,
+	event     TEXT NOT NULL,
+	PRIMARY KEY (room, event_id)
+);
+CREATE INDEX IF NOT EXISTS events_room_day ON events (room, day);
+CREATE INDEX IF NOT EXISTS events_room_timestamp ON events (room, timestamp);
+CREATE INDEX IF NOT EXISTS events_sender ON events (sender);
+CREATE TABLE IF NOT EXISTS room_files (
+	room TEXT NOT NULL,
+	name TEXT NOT NULL,
+	data BLOB NOT NULL,
+	PRIMARY KEY (room, name)
+);
+CREATE TABLE IF NOT EXISTS media (
+	uri  TEXT PRIMARY KEY,
+	hash TEXT NOT NULL
+);
+`
+
+// sqliteUpsertEvent stores an event, replacing the stored version of it
+// unless preferredEvent would keep that (a decrypted event is never replaced
+// by an encrypted one).
+const sqliteUpsertEvent = `
+INSERT INTO events (room, event_id, day, timestamp, sender, type, event) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (room, event_id) DO UPDATE SET
+	day = excluded.day, timestamp = excluded.timestamp, sender = excluded.sender, type = excluded.type, event = excluded.event
+WHERE NOT (excluded.type = 'm.room.encrypted' AND events.type != 'm.room.encrypted')`
+
+// sqliteUpsertRoomFile stores a room file, replacing its stored content.
+const sqliteUpsertRoomFile = `INSERT INTO room_files (room, name, data) VALUES (?, ?, ?) ON CONFLICT (room, name) DO UPDATE SET data = excluded.data`
+
+// sqliteStorage keeps the events, the room metadata, the other room files and
+// the media references in a SQLite database in the backup directory. The media
+// blobs and the other files of the backup stay in the backup directory, so
+// that the backend can be switched without downloading the media again.
+type sqliteStorage struct {
+	db    *sql.DB
+	files *fileStorage
+}
+
+// openSQLiteStorage opens (or creates) the database in the backup directory.
+func openSQLiteStorage(ctx context.Context, backupDir string) (*sqliteStorage, error) {
+	if err := os.MkdirAll(backupDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory %s: %w", backupDir, err)
+	}
+	dbPath := filepath.Join(backupDir, sqliteFilename)
+	db, err := sql.Open(sqliteDriverName, dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", dbPath, err)
+	}
+	// A single connection serializes the writes of the parallel workers, and
+	// keeps the pragmas
+	db.SetMaxOpenConns(1)
+	for _, statement := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", sqliteSchema} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize database %s: %w", dbPath, err)
+		}
+	}
+	return &sqliteStorage{db: db, files: newFileStorage(backupDir)}, nil
+}
+
+func (self *sqliteStorage) Close() error {
+	return self.db.Close()
+}
+
+func (self *sqliteStorage) ListRooms(ctx context.Context) ([]string, error) {
+	rows, err := self.db.QueryContext(ctx, "SELECT dir_name FROM rooms UNION SELECT room FROM events UNION SELECT room FROM room_files ORDER BY 1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+	return scanStrings(rows)
+}
+
+func (self *sqliteStorage) RemoveRoom(ctx context.Context, room string) error {
+	tx, err := self.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to remove room %s: %w", room, err)
+	}
+	defer tx.Rollback()
+	for _, query := range []string{"DELETE FROM rooms WHERE dir_name = ?", "DELETE FROM events WHERE room = ?", "DELETE FROM room_files WHERE room = ?"} {
+		if _, err := tx.ExecContext(ctx, query, room); err != nil {
+			return fmt.Errorf("failed to remove room %s: %w", room, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to remove room %s: %w", room, err)
+	}
+	return nil
+}
+
+func (self *sqliteStorage) ReadMetadata(ctx context.Context, room string) (*Metadata, error) {
+	var meta Metadata
+	err := self.db.QueryRowContext(ctx, "SELECT next_token, backfill_token, membership, predecessor, successor FROM rooms WHERE dir_name = ?", room).
+		Scan(&meta.NextToken, &meta.BackfillToken, &meta.Membership, &meta.Predecessor, &meta.Successor)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to read metadata of room %s: %w", room, err)
+	}
+	return &meta, nil
+}
+
+// sqliteExecer runs statements on the database, or in a transaction.
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// writeMetadata stores the metadata of the room with the execer.
+func writeMetadata(ctx context.Context, execer sqliteExecer, room string, meta *Metadata) error {
+	_, err := execer.ExecContext(ctx, `INSERT INTO rooms (dir_name, next_token, backfill_token, membership, predecessor, successor) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (dir_name) DO UPDATE SET next_token = excluded.next_token, backfill_token = excluded.backfill_token,
+	membership = excluded.membership, predecessor = excluded.predecessor, successor = excluded.successor`,
+		room, meta.NextToken, meta.BackfillToken, meta.Membership, meta.Predecessor, meta.Successor)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata of room %s: %w", room, err)
+	}
+	return nil
+}
+
+func (self *sqliteStorage) WriteMetadata(ctx context.Context, room string, meta *Metadata) error {
+	return writeMetadata(ctx, self.db, room, meta)
+}
+
+func (self *sqliteStorage) ListDays(ctx context.Context, room string) ([]string, error) {
+	rows, err := self.db.QueryContext(ctx, "SELECT DISTINCT day FROM events WHERE room = ? ORDER BY day", room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list days of room %s: %w", room, err)
+	}
+	return scanStrings(rows)
+}
+
+func (self *sqliteStorage) ReadDay(ctx context.Context, room, day string) ([]*event.Event, error) {
+	rows, err := self.db.QueryContext(ctx, "SELECT event FROM events WHERE room = ? AND day = ? ORDER BY timestamp, event_id", room, day)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read day %s of room %s: %w", day, room, err)
+	}
+	data, err := scanStrings(rows)
+	if err != nil {
+		return nil, err
+	}
+	var events []*event.Event
+	for _, eventData := range data {
+		var evt event.Event
+		if err := json.Unmarshal([]byte(eventData), &evt); err != nil {
+			return nil, fmt.Errorf("%w %s of room %s: %w", errCorruptDay, day, room, err)
+		}
+		events = append(events, &evt)
+	}
+	return events, nil
+}
+
+// upsertEvents stores the events of the room in the transaction.
+func upsertEvents(ctx context.Context, tx *sql.Tx, room string, events []*event.Event) error {
+	statement, err := tx.PrepareContext(ctx, sqliteUpsertEvent)
+	if err != nil {
+		return fmt.Errorf("failed to prepare event insert: %w", err)
+	}
+	defer statement.Close()
+	for _, evt := range events {
+		data, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event %s: %w", evt.ID, err)
+		}
+		day := time.UnixMilli(evt.Timestamp).UTC().Format(dayFormat)
+		if _, err := statement.ExecContext(ctx, room, evt.ID, day, evt.Timestamp, evt.Sender, evt.Type.Type, string(data)); err != nil {
+			return fmt.Errorf("failed to store event %s: %w", evt.ID, err)
+		}
+	}
+	return nil
+}
+
+func (self *sqliteStorage) WriteDay(ctx context.Context, room, day string, events []*event.Event) error {
+	tx, err := self.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to write day %s of room %s: %w", day, room, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM events WHERE room = ? AND day = ?", room, day); err != nil {
+		return fmt.Errorf("failed to write day %s of room %s: %w", day, room, err)
+	}
+	if err := upsertEvents(ctx, tx, room, events); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write day %s of room %s: %w", day, room, err)
+	}
+	return nil
+}
+
+// StoreEvents upserts the events, so that only the new events are written
+// instead of the whole days, and the metadata in the same transaction.
+func (self *sqliteStorage) StoreEvents(ctx context.Context, room string, events []*event.Event, meta *Metadata) error {
+	tx, err := self.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to store events of room %s: %w", room, err)
+	}
+	defer tx.Rollback()
+	if err := upsertEvents(ctx, tx, room, events); err != nil {
+		return err
+	}
+	if meta != nil {
+		if err := writeMetadata(ctx, tx, room, meta); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store events of room %s: %w", room, err)
+	}
+	return nil
+}
+
+// QuarantineDay moves the stored events of the day to a JSONL room file, as
+// they are stored (an event per line).
+func (self *sqliteStorage) QuarantineDay(ctx context.Context, room, day string) (string, error) {
+	name := day + jsonlExtension + corruptFileSuffix + time.Now().UTC().Format(corruptTimeFormat)
+	tx, err := self.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to quarantine day %s of room %s: %w", day, room, err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT event FROM events WHERE room = ? AND day = ? ORDER BY timestamp, event_id", room, day)
+	if err != nil {
+		return "", fmt.Errorf("failed to quarantine day %s of room %s: %w", day, room, err)
+	}
+	events, err := scanStrings(rows)
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	for _, eventData := range events {
+		data = append(append(data, eventData...), '\n')
+	}
+	if _, err := tx.ExecContext(ctx, sqliteUpsertRoomFile, room, name, data); err != nil {
+		return "", fmt.Errorf("failed to quarantine day %s of room %s: %w", day, room, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM events WHERE room = ? AND day = ?", room, day); err != nil {
+		return "", fmt.Errorf("failed to quarantine day %s of room %s: %w", day, room, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to quarantine day %s of room %s: %w", day, room, err)
+	}
+	return room + "/" + name, nil
+}
+
+func (self *sqliteStorage) ListRoomFiles(ctx context.Context, room string) ([]string, error) {
+	rows, err := self.db.QueryContext(ctx, "SELECT name FROM room_files WHERE room = ? ORDER BY name", room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files of room %s: %w", room, err)
+	}
+	return scanStrings(rows)
+}
+
+func (self *sqliteStorage) ReadRoomFile(ctx context.Context, room, name string) ([]byte, error) {
+	var data []byte
+	err := self.db.QueryRowContext(ctx, "SELECT data FROM room_files WHERE room = ? AND name = ?", room, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s of room %s: %w", name, room, err)
+	}
+	return data, nil
+}
+
+func (self *sqliteStorage) WriteRoomFile(ctx context.Context, room, name string, data []byte) error {
+	if _, err := self.db.ExecContext(ctx, sqliteUpsertRoomFile, room, name, data); err != nil {
+		return fmt.Errorf("failed to write file %s of room %s: %w", name, room, err)
+	}
+	return nil
+}
+
+func (self *sqliteStorage) HasBlob(ctx context.Context, hash string) (bool, error) {
+	return self.files.HasBlob(ctx, hash)
+}
+
+func (self *sqliteStorage) PutBlob(ctx context.Context, hash, path string) error {
+	return self.files.PutBlob(ctx, hash, path)
+}
+
+// MediaHash returns the hash of the media reference, or of the one recorded
+// by the file storage, so that media downloaded before switching to the
+// database is not downloaded again.
+func (self *sqliteStorage) MediaHash(ctx context.Context, uri id.ContentURIString) (string, error) {
+	var hash string
+	err := self.db.QueryRowContext(ctx, "SELECT hash FROM media WHERE uri = ?", uri).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return self.files.MediaHash(ctx, uri)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read media reference %s: %w", uri, err)
+	}
+	return hash, nil
+}
+
+func (self *sqliteStorage) AddMedia(ctx context.Context, uri id.ContentURIString, hash string) error {
+	if _, err := self.db.ExecContext(ctx, "INSERT INTO media (uri, hash) VALUES (?, ?) ON CONFLICT (uri) DO UPDATE SET hash = excluded.hash", uri, hash); err != nil {
+		return fmt.Errorf("failed to write media reference %s: %w", uri, err)
+	}
+	return nil
+}
+
+func (self *sqliteStorage) TempDir() string {
+	return self.files.TempDir()
+}
+
+func (self *sqliteStorage) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	return self.files.ReadFile(ctx, name)
+}
+
+func (self *sqliteStorage) WriteFile(ctx context.Context, name string, data []byte) error {
+	return self.files.WriteFile(ctx, name, data)
+}
+
+// scanStrings reads the single string column of the rows.
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+	return values, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store, err := openSQLiteStorage(ctx, backupDir)
+	assert.NilError(t, err)
+	roomDirName := "Room:!room:example.org"
+	day := testBackfillDay.UnixMilli()
+
+	encrypted := newTestEvent("$b", day+1, "encrypted")
+	encrypted.Type = event.EventEncrypted
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "b"), newTestEvent("$a", day, "a")}))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{encrypted, newTestEvent("$a", day, "edited"), newTestEvent("$c", day+86400000, "c")}))
+
+	days, err := store.ListDays(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, days, []string{"2024-01-15", "2024-01-16"})
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].ID, id.EventID("$a"))
+	assert.Equal(t, events[0].Content.Raw["body"], "edited")
+	// The decrypted event is not replaced by the encrypted one
+	assert.Equal(t, events[1].Type, event.EventMessage)
+
+	// The metadata is stored in the transaction of the events
+	meta := &Metadata{NextToken: "next", Predecessor: "!old:example.org"}
+	assert.NilError(t, store.StoreEvents(ctx, roomDirName, []*event.Event{newTestEvent("$d", day+2, "d")}, meta))
+	rooms, err := store.ListRooms(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rooms, []string{"Room:!room:example.org"})
+
+	// The data is there when the database is opened again
+	assert.NilError(t, store.Close())
+	store, err = openSQLiteStorage(ctx, backupDir)
+	assert.NilError(t, err)
+	defer store.Close()
+	storedMeta, err := store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, storedMeta, meta)
+
+	_, err = store.QuarantineDay(ctx, roomDirName, "2024-01-16")
+	assert.NilError(t, err)
+	events, err = store.ReadDay(ctx, roomDirName, "2024-01-16")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 0)
+
+	// Blobs stored by the file storage are found, so they are not downloaded again
+	hash := testContentHash(testMediaContent)
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	assert.NilError(t, os.WriteFile(blobPath, []byte(testMediaContent), 0o644))
+	assert.NilError(t, newFileStorage(backupDir).PutBlob(ctx, hash, blobPath))
+	stored, err := store.HasBlob(ctx, hash)
+	assert.NilError(t, err)
+	assert.Assert(t, stored)
+
+	// Media references are stored in the database, and those of the file storage are found too
+	assert.NilError(t, newFileStorage(backupDir).AddMedia(ctx, "mxc://example.org/file", hash))
+	assert.NilError(t, store.AddMedia(ctx, testMediaURI, hash))
+	for _, uri := range []id.ContentURIString{testMediaURI, "mxc://example.org/file"} {
+		storedHash, err := store.MediaHash(ctx, uri)
+		assert.NilError(t, err)
+		assert.Equal(t, storedHash, hash, uri)
+	}
+	fileHash, err := newFileStorage(backupDir).MediaHash(ctx, testMediaURI)
+	assert.NilError(t, err)
+	assert.Equal(t, fileHash, "")
+
+	assert.NilError(t, store.RemoveRoom(ctx, roomDirName))
+	rooms, err = store.ListRooms(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rooms), 0)
+}
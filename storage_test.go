@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// memoryStorage is a backupStorage keeping everything in memory, keyed by the
+// directory names of the rooms.
+type memoryStorage struct {
+	metadata    map[string]Metadata
+	days        map[string]map[string][]*event.Event
+	files       map[string]map[string][]byte
+	quarantined map[string][]*event.Event
+	blobs       map[string]bool
+	media       map[id.ContentURIString]string
+	backupFiles map[string][]byte
+	tmpDir      string
+}
+
+func newMemoryStorage(tmpDir string) *memoryStorage {
+	return &memoryStorage{
+		media:       make(map[id.ContentURIString]string),
+		backupFiles: make(map[string][]byte),
+		tmpDir:      tmpDir,
+		metadata:    make(map[string]Metadata),
+		days:        make(map[string]map[string][]*event.Event),
+		files:       make(map[string]map[string][]byte),
+		quarantined: make(map[string][]*event.Event),
+		blobs:       make(map[string]bool),
+	}
+}
+
+func (self *memoryStorage) ListRooms(context.Context) ([]string, error) {
+	var rooms []string
+	for room := range self.days {
+		rooms = append(rooms, room)
+	}
+	for room := range self.metadata {
+		if _, ok := self.days[room]; !ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+func (self *memoryStorage) RemoveRoom(_ context.Context, room string) error {
+	delete(self.metadata, room)
+	delete(self.days, room)
+	delete(self.files, room)
+	return nil
+}
+
+func (self *memoryStorage) ReadMetadata(_ context.Context, room string) (*Metadata, error) {
+	meta := self.metadata[room]
+	return &meta, nil
+}
+
+func (self *memoryStorage) WriteMetadata(_ context.Context, room string, meta *Metadata) error {
+	self.metadata[room] = *meta
+	return nil
+}
+
+func (self *memoryStorage) ListDays(_ context.Context, room string) ([]string, error) {
+	var days []string
+	for day := range self.days[room] {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (self *memoryStorage) ReadDay(_ context.Context, room, day string) ([]*event.Event, error) {
+	events := self.days[room][day]
+	if events != nil && events[0] == nil {
+		return nil, fmt.Errorf("%w %s", errCorruptDay, day)
+	}
+	return slices.Clone(events), nil
+}
+
+func (self *memoryStorage) WriteDay(_ context.Context, room, day string, events []*event.Event) error {
+	if self.days[room] == nil {
+		self.days[room] = make(map[string][]*event.Event)
+	}
+	self.days[room][day] = slices.Clone(events)
+	return nil
+}
+
+func (self *memoryStorage) StoreEvents(ctx context.Context, room string, events []*event.Event, meta *Metadata) error {
+	if err := mergeDays(ctx, self, room, events); err != nil || meta == nil {
+		return err
+	}
+	return self.WriteMetadata(ctx, room, meta)
+}
+
+func (self *memoryStorage) QuarantineDay(_ context.Context, room, day string) (string, error) {
+	location := room + "/" + day
+	self.quarantined[location] = self.days[room][day]
+	delete(self.days[room], day)
+	return location, nil
+}
+
+func (self *memoryStorage) ListRoomFiles(_ context.Context, room string) ([]string, error) {
+	var names []string
+	for name := range self.files[room] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (self *memoryStorage) ReadRoomFile(_ context.Context, room, name string) ([]byte, error) {
+	return self.files[room][name], nil
+}
+
+func (self *memoryStorage) WriteRoomFile(_ context.Context, room, name string, data []byte) error {
+	if self.files[room] == nil {
+		self.files[room] = make(map[string][]byte)
+	}
+	self.files[room][name] = data
+	return nil
+}
+
+func (self *memoryStorage) HasBlob(_ context.Context, hash string) (bool, error) {
+	return self.blobs[hash], nil
+}
+
+func (self *memoryStorage) PutBlob(_ context.Context, hash, path string) error {
+	self.blobs[hash] = true
+	return os.Remove(path)
+}
+
+func (self *memoryStorage) MediaHash(_ context.Context, uri id.ContentURIString) (string, error) {
+	return self.media[uri], nil
+}
+
+func (self *memoryStorage) AddMedia(_ context.Context, uri id.ContentURIString, hash string) error {
+	self.media[uri] = hash
+	return nil
+}
+
+func (self *memoryStorage) TempDir() string {
+	return self.tmpDir
+}
+
+func (self *memoryStorage) ReadFile(_ context.Context, name string) ([]byte, error) {
+	return self.backupFiles[name], nil
+}
+
+func (self *memoryStorage) WriteFile(_ context.Context, name string, data []byte) error {
+	self.backupFiles[name] = data
+	return nil
+}
+
+func TestProcessEventsMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage(t.TempDir())
+	roomDirName := "Room:!room:example.org"
+	day := testBackfillDay.UnixMilli()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "b"), newTestEvent("$a", day, "a")}))
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$b", day+1, "edited"), newTestEvent("$c", day+86400000, "c")}))
+
+	days, err := store.ListDays(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, days, []string{"2024-01-15", "2024-01-16"})
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].ID, id.EventID("$a"))
+	assert.Equal(t, events[1].Content.AsMessage().Body, "edited")
+
+	// Unreadable days are quarantined, not overwritten
+	store.days[roomDirName]["2024-01-16"] = []*event.Event{nil}
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$d", day+86400000, "d")}))
+	events, err = store.ReadDay(ctx, roomDirName, "2024-01-16")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, len(store.quarantined), 1)
+}
+
+func TestMergeOldRoomDataMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage(t.TempDir())
+	day := testBackfillDay.UnixMilli()
+	oldDirName, newDirName := "Old:!room:example.org", "New:!room:example.org"
+	assert.NilError(t, processEvents(ctx, store, oldDirName, []*event.Event{newTestEvent("$old", day, "old")}))
+	assert.NilError(t, store.WriteRoomFile(ctx, oldDirName, "state-2024-01-15T120000Z.json", []byte("[]")))
+	assert.NilError(t, processEvents(ctx, store, newDirName, []*event.Event{newTestEvent("$new", day+1, "new")}))
+	assert.NilError(t, processEvents(ctx, store, "Other:!other:example.org", []*event.Event{newTestEvent("$other", day, "other")}))
+
+	assert.NilError(t, mergeOldRoomData(ctx, store, testRoomID, newDirName, zerolog.Nop()))
+	rooms, err := store.ListRooms(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rooms, []string{"New:!room:example.org", "Other:!other:example.org"})
+	timeline, err := readRoomTimeline(ctx, store, newDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 2)
+	assert.Equal(t, timeline[0].ID, id.EventID("$old"))
+	names, err := store.ListRoomFiles(ctx, newDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, names, []string{"state-2024-01-15T120000Z.json"})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	syncStoreFilename = "sync.json"
+
+	// roomSyncFilter includes only the timelines of the rooms, with the given
+	// include_leave and timeline limit
+	roomSyncFilter = `{"room":{"include_leave":%t,"timeline":{"limit":%d},"state":{"types":[]},"ephemeral":{"types":[]},"account_data":{"types":[]}},"presence":{"types":[]},"account_data":{"types":[]}}`
+	// The incremental mode needs only to know which rooms had activity, as the
+	// timelines are fetched with /messages anyway
+	incrementalTimelineLimit = 1
+)
+
+// syncStoreData is the on-disk format of the sync store.
+type syncStoreData struct {
+	UserID    id.UserID `json:"user_id"`
+	FilterID  string    `json:"filter_id,omitempty"`
+	NextBatch string    `json:"next_batch,omitempty"`
+
+	// Rooms which are not archived up to NextBatch, in watch mode
+	PendingRooms map[id.RoomID]event.Membership `json:"pending_rooms,omitempty"`
+}
+
+// fileSyncStore is a mautrix.SyncStore which keeps the sync token in a file
+// of the backup storage, so that the incremental mode can continue from the
+// previous run.
+type fileSyncStore struct {
+	store backupStorage
+	lock  sync.Mutex
+}
+
+var _ mautrix.SyncStore = (*fileSyncStore)(nil)
+
+func newFileSyncStore(store backupStorage) *fileSyncStore {
+	return &fileSyncStore{store: store}
+}
+
+// load reads the stored data of the user; data of another user is ignored.
+// The caller must hold the lock.
+func (self *fileSyncStore) load(ctx context.Context, userID id.UserID) (*syncStoreData, error) {
+	data, err := self.store.ReadFile(ctx, syncStoreFilename)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return &syncStoreData{UserID: userID}, nil
+	}
+	var stored syncStoreData
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sync store %s: %w", syncStoreFilename, err)
+	}
+	if stored.UserID != userID {
+		return &syncStoreData{UserID: userID}, nil
+	}
+	return &stored, nil
+}
+
+// update modifies the stored data of the user and writes it back.
+func (self *fileSyncStore) update(ctx context.Context, userID id.UserID, modify func(*syncStoreData)) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stored, err := self.load(ctx, userID)
+	if err != nil {
+		return err
+	}
+	modify(stored)
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync store: %w", err)
+	}
+	return self.store.WriteFile(ctx, syncStoreFilename, data)
+}
+
+func (self *fileSyncStore) SaveFilterID(ctx context.Context, userID id.UserID, filterID string) error {
+	return self.update(ctx, userID, func(stored *syncStoreData) { stored.FilterID = filterID })
+}
+
+func (self *fileSyncStore) LoadFilterID(ctx context.Context, userID id.UserID) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stored, err := self.load(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return stored.FilterID, nil
+}
+
+func (self *fileSyncStore) SaveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+	return self.update(ctx, userID, func(stored *syncStoreData) { stored.NextBatch = nextBatchToken })
+}
+
+func (self *fileSyncStore) LoadNextBatch(ctx context.Context, userID id.UserID) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stored, err := self.load(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return stored.NextBatch, nil
+}
+
+// saveWatchPosition stores the sync token together with the rooms which are
+// not archived up to it.
+func (self *fileSyncStore) saveWatchPosition(ctx context.Context, userID id.UserID, nextBatch string, pendingRooms map[id.RoomID]event.Membership) error {
+	return self.update(ctx, userID, func(stored *syncStoreData) {
+		stored.NextBatch = nextBatch
+		stored.PendingRooms = pendingRooms
+	})
+}
+
+// loadWatchPosition returns the sync token and the rooms which are not
+// archived up to it.
+func (self *fileSyncStore) loadWatchPosition(ctx context.Context, userID id.UserID) (string, map[id.RoomID]event.Membership, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stored, err := self.load(ctx, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	return stored.NextBatch, stored.PendingRooms, nil
+}
+
+// activeSyncRooms returns the rooms with timeline activity in the sync
+// response. Left and invited rooms are included only if includeLeft is set.
+func activeSyncRooms(userID id.UserID, resp *mautrix.RespSync, includeLeft bool) []roomMembership {
+	var rooms []roomMembership
+	for roomID, joinedRoom := range resp.Rooms.Join {
+		if len(joinedRoom.Timeline.Events) > 0 {
+			rooms = append(rooms, roomMembership{RoomID: roomID, Membership: event.MembershipJoin})
+		}
+	}
+	if includeLeft {
+		for roomID, leftRoom := range resp.Rooms.Leave {
+			if len(leftRoom.Timeline.Events) > 0 {
+				rooms = append(rooms, roomMembership{RoomID: roomID, Membership: leftRoomMembership(userID, leftRoom)})
+			}
+		}
+		for roomID := range resp.Rooms.Invite {
+			rooms = append(rooms, roomMembership{RoomID: roomID, Membership: event.MembershipInvite})
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms
+}
+
+// roomSyncRequest creates a sync request for the room timelines.
+func roomSyncRequest(since string, timelineLimit int, timeout time.Duration, cli *CLI) mautrix.ReqSync {
+	return mautrix.ReqSync{
+		Since:    since,
+		FilterID: fmt.Sprintf(roomSyncFilter, cli.IncludeLeft, timelineLimit),
+		Timeout:  int(timeout.Milliseconds()),
+	}
+}
+
+// syncRooms makes the sync request, handing the received to-device events to
+// the crypto machine.
+func syncRooms(ctx context.Context, client *mautrix.Client, req mautrix.ReqSync) (*mautrix.RespSync, error) {
+	resp, err := client.FullSyncRequest(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync: %w", err)
+	}
+	if machine, ok := client.Crypto.(*cryptoMachine); ok {
+		if err := machine.receiveSync(ctx, resp, req.Since); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// backupIncremental backs up only the rooms which had timeline activity since
+// the sync token of the previous run. Their timelines are fetched with
+// /messages from the room tokens as usual, so limited sync timelines are
+// filled too. Without a sync token, a full backup is made first. The sync
+// token is saved only if all rooms were backed up, so failed rooms are
+// visited again on the next run.
+func backupIncremental(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) error {
+	store, media, err := prepareBackupDir(ctx, cli, logger)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(store, logger)
+	client.Store = newFileSyncStore(store)
+	since, err := client.Store.LoadNextBatch(ctx, client.UserID)
+	if err != nil {
+		return err
+	}
+	if since == "" {
+		logger.Info().Msg("No sync token from a previous run, making a full backup")
+		// The token is taken before the backup, so that activity during it is not missed
+		resp, err := syncRooms(ctx, client, roomSyncRequest("", incrementalTimelineLimit, 0, cli))
+		if err != nil {
+			return err
+		}
+		rooms, err := listRooms(ctx, client, cli, logger)
+		if err != nil {
+			return err
+		}
+		if err := backupRoomList(ctx, client, rooms, cli, store, media, logger); err != nil {
+			return err
+		}
+		return client.Store.SaveNextBatch(ctx, client.UserID, resp.NextBatch)
+	}
+
+	logger.Info().Msg("Syncing room activity since the previous run...")
+	resp, err := syncRooms(ctx, client, roomSyncRequest(since, incrementalTimelineLimit, 0, cli))
+	if err != nil {
+		return err
+	}
+	rooms := activeSyncRooms(client.UserID, resp, cli.IncludeLeft)
+	logger.Info().Int("count", len(rooms)).Msg("Found rooms with new activity")
+	if err := backupRoomList(ctx, client, rooms, cli, store, media, logger); err != nil {
+		return err
+	}
+	return client.Store.SaveNextBatch(ctx, client.UserID, resp.NextBatch)
+}
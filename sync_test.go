@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFileSyncStore(t *testing.T) {
+	ctx := context.Background()
+	store := newFileSyncStore(newFileStorage(t.TempDir()))
+	assert.NilError(t, store.SaveNextBatch(ctx, "@user:example.org", "batch"))
+	assert.NilError(t, store.SaveFilterID(ctx, "@user:example.org", "filter"))
+
+	nextBatch, err := store.LoadNextBatch(ctx, "@user:example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, nextBatch, "batch")
+	filterID, err := store.LoadFilterID(ctx, "@user:example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, filterID, "filter")
+
+	// The token of another user is not used
+	nextBatch, err = store.LoadNextBatch(ctx, "@other:example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, nextBatch, "")
+}
+
+func TestBackupIncremental(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	server, _ := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/sync": map[string]any{
+			"next_batch": "s2",
+			"rooms": map[string]any{"join": map[string]any{
+				testRoomID.String():  map[string]any{"timeline": map[string]any{"limited": true, "events": []any{newTestMessagesEvent("$new", "m.room.message", 1)}}},
+				"!quiet:example.org": map[string]any{"timeline": map[string]any{"events": []any{}}},
+			}},
+		},
+		"b:":              map[string]any{"start": "now", "chunk": []any{newTestMessagesEvent("$create", "m.room.create", 0), newTestMessagesEvent("$new", "m.room.message", 1)}},
+		"f:now":           map[string]any{"start": "now", "end": "now", "chunk": []any{}},
+		testRoomStatePath: []any{},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	client.Store = newFileSyncStore(store)
+	assert.NilError(t, client.Store.SaveNextBatch(ctx, client.UserID, "s1"))
+	cli := &CLI{BackupDir: backupDir, HistoryOrder: historyOrderBackward}
+
+	assert.NilError(t, backupIncremental(ctx, client, cli, zerolog.Nop()))
+	nextBatch, err := client.Store.LoadNextBatch(ctx, client.UserID)
+	assert.NilError(t, err)
+	assert.Equal(t, nextBatch, "s2")
+	roomDirName, ok := findRoomDirName(ctx, store, testRoomID)
+	assert.Assert(t, ok)
+	assert.Assert(t, fileExists(filepath.Join(backupDir, roomDirName, "2024-01-16.json")))
+	_, ok = findRoomDirName(ctx, store, id.RoomID("!quiet:example.org"))
+	assert.Assert(t, !ok)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// roomUpgradeLinks finds the room this room was upgraded from (the
+// predecessor of m.room.create) and the room it was upgraded to (the
+// replacement room of m.room.tombstone) in the room state.
+func roomUpgradeLinks(stateEvents []*event.Event) (id.RoomID, id.RoomID) {
+	var predecessor, successor id.RoomID
+	for _, evt := range stateEvents {
+		if evt.GetStateKey() != "" {
+			continue
+		}
+		switch evt.Type.Type {
+		case event.StateCreate.Type:
+			if pred, ok := evt.Content.Raw["predecessor"].(map[string]any); ok {
+				if roomID, ok := pred["room_id"].(string); ok {
+					predecessor = id.RoomID(roomID)
+				}
+			}
+		case event.StateTombstone.Type:
+			if roomID, ok := evt.Content.Raw["replacement_room"].(string); ok {
+				successor = id.RoomID(roomID)
+			}
+		}
+	}
+	return predecessor, successor
+}
+
+// updateUpgradeLinks records the upgrade links found in the room state in the
+// metadata. Links are only added or changed, never removed, as the state of
+// rooms we have left may no longer be readable.
+func updateUpgradeLinks(ctx context.Context, store backupStorage, roomDirName string, meta *Metadata, stateEvents []*event.Event, roomLog zerolog.Logger) error {
+	predecessor, successor := roomUpgradeLinks(stateEvents)
+	changed := false
+	if predecessor != "" && predecessor != meta.Predecessor {
+		meta.Predecessor = predecessor
+		changed = true
+	}
+	if successor != "" && successor != meta.Successor {
+		meta.Successor = successor
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	roomLog.Info().Str("predecessor", meta.Predecessor.String()).Str("successor", meta.Successor.String()).Msg("Room upgrade links changed")
+	return store.WriteMetadata(ctx, roomDirName, meta)
+}
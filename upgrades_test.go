@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestStateEvent(eventType event.Type, content map[string]any) *event.Event {
+	stateKey := ""
+	return &event.Event{Type: eventType, StateKey: &stateKey, Content: event.Content{Raw: content}}
+}
+
+func TestUpdateUpgradeLinks(t *testing.T) {
+	ctx := context.Background()
+	store := newFileStorage(t.TempDir())
+	roomDirName := "Room:" + testRoomID.String()
+	meta := &Metadata{NextToken: "token"}
+	stateEvents := []*event.Event{
+		newTestStateEvent(event.StateCreate, map[string]any{"predecessor": map[string]any{"room_id": "!old:example.org", "event_id": "$tombstone"}}),
+	}
+	assert.NilError(t, updateUpgradeLinks(ctx, store, roomDirName, meta, stateEvents, zerolog.Nop()))
+	stored, err := store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stored, &Metadata{NextToken: "token", Predecessor: "!old:example.org"})
+
+	// The room is upgraded, and later its state is no longer readable
+	stateEvents = append(stateEvents, newTestStateEvent(event.StateTombstone, map[string]any{"replacement_room": "!new:example.org", "body": "Upgraded"}))
+	assert.NilError(t, updateUpgradeLinks(ctx, store, roomDirName, meta, stateEvents, zerolog.Nop()))
+	assert.NilError(t, updateUpgradeLinks(ctx, store, roomDirName, meta, nil, zerolog.Nop()))
+	stored, err = store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, stored.Predecessor, id.RoomID("!old:example.org"))
+	assert.Equal(t, stored.Successor, id.RoomID("!new:example.org"))
+}
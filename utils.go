@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -21,3 +25,60 @@ func sanitizeFilename(name string) string {
 	}
 	return sanitized
 }
+
+// fileExists checks if a regular file exists
+func fileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir()
+}
+
+// writeFileAtomic writes the data to a temporary file next to the path, syncs
+// it and renames it over the path, so that the file has either its old or its
+// new content even if the process or the system stops mid-write.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err = errors.Join(err, file.Close()); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	// Sync the directory too, so that the rename is durable (not supported on all platforms)
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// readLinesForAppend reads the complete lines of the line-based file which is
+// appended to. A partial last line, left by an interrupted write, is dropped
+// from the file, so that the appended lines are not corrupted.
+func readLinesForAppend(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if complete := bytes.LastIndexByte(data, '\n') + 1; complete < len(data) {
+		data = data[:complete]
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	watchSyncTimeout     = 30 * time.Second // Long-poll timeout of the syncs in watch mode
+	watchReconcileBudget = 30 * time.Second // Time spent on the full backup between two syncs in watch mode
+)
+
+// roomWatcher archives the new events of the rooms as they arrive in the syncs.
+// All rooms are archived up to the position of the last processed sync,
+// except the pending ones.
+type roomWatcher struct {
+	client    *mautrix.Client
+	cli       *CLI
+	store     backupStorage
+	syncStore *fileSyncStore
+	media     *mediaStore
+	logger    zerolog.Logger
+
+	// Rooms not archived up to the sync position, to back up fully (failed,
+	// left and invited rooms, and the rooms of the first full backup). Rooms
+	// of the ongoing full backup are left to it.
+	pendingRooms map[id.RoomID]roomMembership
+
+	// Rooms left to back up in the ongoing full backup, done between the syncs
+	reconcileRooms  []roomMembership
+	reconcileFailed bool
+}
+
+// appendTimeline writes the events of the sync timeline of the room directly
+// to its daily files. The room must have been archived up to the since token
+// of the sync, and the timeline must not be limited (i.e. it has all the
+// events since then). Returns whether the events were written.
+func (self *roomWatcher) appendTimeline(ctx context.Context, roomID id.RoomID, timeline *mautrix.SyncTimeline, nextBatch string) (bool, error) {
+	if timeline.Limited {
+		return false, nil
+	}
+	roomDirName, ok := findRoomDirName(ctx, self.store, roomID)
+	if !ok {
+		return false, nil
+	}
+	meta, err := self.store.ReadMetadata(ctx, roomDirName)
+	if err != nil {
+		return false, err
+	}
+
+	roomLog := self.logger.With().Str("room_id", roomID.String()).Str("room_dir", roomDirName).Logger()
+	ctx = roomLog.WithContext(ctx) // For the storage
+	// Events of the sync do not include the room ID
+	for _, evt := range timeline.Events {
+		evt.RoomID = roomID
+	}
+	// Sync tokens can be used to paginate /messages too
+	meta.NextToken = nextBatch
+	if err := processMessageChunk(ctx, self.client, roomID, self.store, roomDirName, timeline.Events, meta, roomLog, self.media); err != nil {
+		return false, err
+	}
+	if err := finishRoom(ctx, self.store, roomDirName); err != nil {
+		return false, err
+	}
+	roomLog.Debug().Int("count", len(timeline.Events)).Msg("Archived new events")
+	return true, nil
+}
+
+// backupRoom backs up the room with /messages from its stored token. The
+// backup reaches past the sync position, so no events are missed.
+func (self *roomWatcher) backupRoom(ctx context.Context, room roomMembership) error {
+	_, err := backupRoom(ctx, self.logger, self.client, room, self.cli, self.store, self.media)
+	return err
+}
+
+// processSync archives the new events of the rooms in the sync response.
+// Rooms without events in it stay archived up to its position. Rooms which
+// fail are retried (with a full room backup) on the following syncs.
+func (self *roomWatcher) processSync(ctx context.Context, resp *mautrix.RespSync) {
+	type roomTimeline struct {
+		room     roomMembership
+		timeline *mautrix.SyncTimeline
+	}
+	var timelines []roomTimeline
+	for roomID, joinedRoom := range resp.Rooms.Join {
+		if len(joinedRoom.Timeline.Events) > 0 {
+			timelines = append(timelines, roomTimeline{roomMembership{RoomID: roomID, Membership: event.MembershipJoin}, &joinedRoom.Timeline})
+		}
+	}
+	for _, room := range activeSyncRooms(self.client.UserID, resp, self.cli.IncludeLeft) {
+		if room.Membership != event.MembershipJoin {
+			// Timelines of left rooms end at leaving, and invites have none
+			self.pendingRooms[room.RoomID] = room
+		}
+	}
+
+	for _, entry := range timelines {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, pending := self.pendingRooms[entry.room.RoomID]; pending {
+			continue
+		}
+		appended, err := self.appendTimeline(ctx, entry.room.RoomID, entry.timeline, resp.NextBatch)
+		if err == nil && !appended {
+			err = self.backupRoom(ctx, entry.room)
+		}
+		if err != nil {
+			self.logger.Error().Str("room_id", entry.room.RoomID.String()).Err(err).Msg("Failed to archive room events, retrying later")
+			self.pendingRooms[entry.room.RoomID] = entry.room
+		}
+	}
+
+	reconciling := make(map[id.RoomID]bool, len(self.reconcileRooms))
+	for _, room := range self.reconcileRooms {
+		reconciling[room.RoomID] = true
+	}
+	for roomID, room := range self.pendingRooms {
+		if ctx.Err() != nil {
+			return
+		}
+		if reconciling[roomID] {
+			continue
+		}
+		if err := self.backupRoom(ctx, room); err != nil {
+			self.logger.Error().Str("room_id", roomID.String()).Err(err).Msg("Failed to back up room, retrying later")
+			continue
+		}
+		delete(self.pendingRooms, roomID)
+	}
+}
+
+// savePosition records the position of the processed sync, together with the
+// rooms which are not archived up to it.
+func (self *roomWatcher) savePosition(ctx context.Context, nextBatch string) error {
+	pendingRooms := make(map[id.RoomID]event.Membership, len(self.pendingRooms))
+	for roomID, room := range self.pendingRooms {
+		pendingRooms[roomID] = room.Membership
+	}
+	if err := self.syncStore.saveWatchPosition(ctx, self.client.UserID, nextBatch, pendingRooms); err != nil {
+		return fmt.Errorf("failed to save sync token: %w", err)
+	}
+	return nil
+}
+
+// startReconcile starts a full backup of all rooms, like a normal run. The
+// rooms are backed up by reconcileStep between the syncs.
+func (self *roomWatcher) startReconcile(ctx context.Context) error {
+	self.logger.Info().Msg("Reconciling all rooms with a full backup...")
+	rooms, err := listRooms(ctx, self.client, self.cli, self.logger)
+	if err != nil {
+		return fmt.Errorf("failed to list rooms for the full backup: %w", err)
+	}
+	self.reconcileRooms = rooms
+	self.reconcileFailed = false
+	return nil
+}
+
+// reconcileStep backs up the rooms of the ongoing full backup, as many at a
+// time as --parallel allows, until the time budget is used up, so that the
+// syncs are not held up for long. At least one batch of rooms is backed up.
+// The pending rooms of a batch which fails are left to the following syncs.
+func (self *roomWatcher) reconcileStep(ctx context.Context, budget time.Duration) {
+	deadline := time.Now().Add(budget)
+	for len(self.reconcileRooms) > 0 && ctx.Err() == nil {
+		batch := self.reconcileRooms[:min(len(self.reconcileRooms), max(self.cli.Parallel, 1))]
+		err := backupRoomList(ctx, self.client, batch, self.cli, self.store, self.media, self.logger)
+		if ctx.Err() != nil {
+			// The interrupted rooms are backed up again on the next run
+			return
+		}
+		if err != nil {
+			self.logger.Error().Err(err).Msg("Failed to back up rooms")
+			self.reconcileFailed = true
+		} else {
+			for _, room := range batch {
+				delete(self.pendingRooms, room.RoomID)
+			}
+		}
+		self.reconcileRooms = self.reconcileRooms[len(batch):]
+		if len(self.reconcileRooms) == 0 {
+			if self.reconcileFailed {
+				self.logger.Error().Msg("Full backup finished with errors")
+			} else {
+				self.logger.Info().Msg("Full backup finished")
+			}
+			return
+		}
+		if !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// sleepContext waits for the duration, or until the context is cancelled.
+func sleepContext(ctx context.Context, duration time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// watchRooms keeps archiving the new events of the rooms as they arrive,
+// long-polling /sync, until the context is cancelled. All rooms are backed up
+// fully at start and then periodically, to catch anything the syncs missed.
+// The full backups are done in steps between the syncs, so that new events
+// keep being archived meanwhile. The sync token is kept in the same place as
+// in the incremental mode, together with the pending rooms.
+func watchRooms(ctx context.Context, client *mautrix.Client, cli *CLI, logger zerolog.Logger) error {
+	store, media, err := prepareBackupDir(ctx, cli, logger)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(store, logger)
+	syncStore := newFileSyncStore(store)
+	client.Store = syncStore
+	watcher := &roomWatcher{client: client, cli: cli, store: store, syncStore: syncStore, media: media, logger: logger, pendingRooms: make(map[id.RoomID]roomMembership)}
+
+	since, pendingRooms, err := syncStore.loadWatchPosition(ctx, client.UserID)
+	if err != nil {
+		return err
+	}
+	for roomID, membership := range pendingRooms {
+		watcher.pendingRooms[roomID] = roomMembership{RoomID: roomID, Membership: membership}
+	}
+	firstBackup := since == ""
+	if firstBackup {
+		// The token is taken before the full backup, so that activity during it is not missed
+		resp, err := syncRooms(ctx, client, roomSyncRequest("", incrementalTimelineLimit, 0, cli))
+		if err != nil {
+			return err
+		}
+		since = resp.NextBatch
+	}
+	if err := watcher.startReconcile(ctx); err != nil {
+		return err
+	}
+	if firstBackup {
+		// No room is archived up to the token before the full backup
+		for _, room := range watcher.reconcileRooms {
+			watcher.pendingRooms[room.RoomID] = room
+		}
+	}
+	lastReconcile := time.Now()
+
+	logger.Info().Msg("Watching for new events...")
+	for ctx.Err() == nil {
+		if len(watcher.reconcileRooms) == 0 && time.Since(lastReconcile) >= cli.ReconcileInterval {
+			if err := watcher.startReconcile(ctx); err != nil {
+				logger.Error().Err(err).Msg("Failed to start the full backup")
+			}
+			lastReconcile = time.Now()
+		}
+		watcher.reconcileStep(ctx, watchReconcileBudget)
+		timeout := watchSyncTimeout
+		if len(watcher.reconcileRooms) > 0 {
+			// Do not wait for new events while the full backup is ongoing
+			timeout = 0
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		resp, err := syncRooms(ctx, client, roomSyncRequest(since, fetchLimit, timeout, cli))
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			logger.Warn().Err(err).Dur("retry_delay", matrixConnectionRetryDelay).Msg("Sync failed, retrying after delay")
+			sleepContext(ctx, matrixConnectionRetryDelay)
+			continue
+		}
+		watcher.processSync(ctx, resp)
+		if ctx.Err() != nil {
+			// The events of the interrupted sync are fetched again on the next run
+			break
+		}
+		since = resp.NextBatch
+		if err := watcher.savePosition(ctx, since); err != nil {
+			return err
+		}
+	}
+	logger.Info().Msg("Stopped watching")
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestWatcherProcessSync(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	const otherRoomID = id.RoomID("!other:example.org")
+	server, _ := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/rooms/!other:example.org/messages": map[string]any{"start": "now", "chunk": []any{}},
+		"/_matrix/client/v3/rooms/!other:example.org/state":    []any{},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	cli := &CLI{BackupDir: backupDir, HistoryOrder: historyOrderBackward}
+	watcher := &roomWatcher{client: client, cli: cli, store: store, logger: zerolog.Nop(), pendingRooms: make(map[id.RoomID]roomMembership)}
+
+	roomDirName := "Room:" + testRoomID.String()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$old", testBackfillDay.UnixMilli(), "old")}))
+	assert.NilError(t, store.WriteMetadata(ctx, roomDirName, &Metadata{NextToken: "t1"}))
+
+	resp := &mautrix.RespSync{NextBatch: "s2"}
+	resp.Rooms.Join = map[id.RoomID]*mautrix.SyncJoinedRoom{
+		testRoomID:  {Timeline: mautrix.SyncTimeline{SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{newTestEvent("$live", testBackfillDay.UnixMilli()+1, "live")}}}},
+		otherRoomID: {Timeline: mautrix.SyncTimeline{SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{newTestEvent("$first", testBackfillDay.UnixMilli(), "first")}}, Limited: true}},
+	}
+	watcher.processSync(ctx, resp)
+	assert.Equal(t, len(watcher.pendingRooms), 0)
+
+	// The room archived up to the sync position gets the events directly,
+	// whatever its /messages token
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[1].RoomID, testRoomID)
+	meta, err := store.ReadMetadata(ctx, roomDirName)
+	assert.NilError(t, err)
+	assert.Equal(t, meta.NextToken, "s2")
+
+	// The new room is backed up with /messages
+	_, ok := findRoomDirName(ctx, store, otherRoomID)
+	assert.Assert(t, ok)
+}
+
+func TestWatcherIdleRoom(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	server, requests := newTestHomeserver(t, map[string]any{})
+	client := newTestServerCryptoMachine(t, server).client
+	syncStore := newFileSyncStore(store)
+	watcher := &roomWatcher{client: client, cli: &CLI{BackupDir: backupDir}, store: store, syncStore: syncStore, logger: zerolog.Nop(), pendingRooms: make(map[id.RoomID]roomMembership)}
+	watcher.pendingRooms["!failed:example.org"] = roomMembership{RoomID: "!failed:example.org", Membership: event.MembershipJoin}
+
+	roomDirName := "Room:" + testRoomID.String()
+	assert.NilError(t, processEvents(ctx, store, roomDirName, []*event.Event{newTestEvent("$old", testBackfillDay.UnixMilli(), "old")}))
+	assert.NilError(t, store.WriteMetadata(ctx, roomDirName, &Metadata{NextToken: "s1"}))
+
+	// The room is idle in the first sync, so it stays archived up to its position
+	watcher.processSync(ctx, &mautrix.RespSync{NextBatch: "s2"})
+	assert.NilError(t, watcher.savePosition(ctx, "s2"))
+
+	// and the message of the next sync is appended without /messages
+	resp := &mautrix.RespSync{NextBatch: "s3"}
+	resp.Rooms.Join = map[id.RoomID]*mautrix.SyncJoinedRoom{
+		testRoomID: {Timeline: mautrix.SyncTimeline{SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{newTestEvent("$new", testBackfillDay.UnixMilli()+1, "new")}}}},
+	}
+	watcher.processSync(ctx, resp)
+	assert.Equal(t, requests.count(testRoomMessagesPath), 0)
+	events, err := store.ReadDay(ctx, roomDirName, "2024-01-15")
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+
+	// The failing room stays pending with the sync position
+	assert.NilError(t, watcher.savePosition(ctx, "s3"))
+	since, pendingRooms, err := syncStore.loadWatchPosition(ctx, client.UserID)
+	assert.NilError(t, err)
+	assert.Equal(t, since, "s3")
+	assert.DeepEqual(t, pendingRooms, map[id.RoomID]event.Membership{"!failed:example.org": event.MembershipJoin})
+}
+
+func TestWatcherReconcileStep(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := newFileStorage(backupDir)
+	server, _ := newTestHomeserver(t, map[string]any{
+		"/_matrix/client/v3/rooms/!a:example.org/messages": map[string]any{"start": "now", "chunk": []any{}},
+		"/_matrix/client/v3/rooms/!a:example.org/state":    []any{},
+		"/_matrix/client/v3/rooms/!b:example.org/messages": map[string]any{"start": "now", "chunk": []any{}},
+		"/_matrix/client/v3/rooms/!b:example.org/state":    []any{},
+	})
+	client := newTestServerCryptoMachine(t, server).client
+	cli := &CLI{BackupDir: backupDir, HistoryOrder: historyOrderBackward, Parallel: 1}
+	watcher := &roomWatcher{client: client, cli: cli, store: store, logger: zerolog.Nop(), pendingRooms: make(map[id.RoomID]roomMembership)}
+	watcher.reconcileRooms = []roomMembership{{RoomID: "!a:example.org", Membership: event.MembershipJoin}, {RoomID: "!b:example.org", Membership: event.MembershipJoin}}
+
+	// Each step backs up a batch of rooms even without time left
+	watcher.reconcileStep(ctx, 0)
+	assert.Equal(t, len(watcher.reconcileRooms), 1)
+	_, ok := findRoomDirName(ctx, store, "!a:example.org")
+	assert.Assert(t, ok)
+	watcher.reconcileStep(ctx, 0)
+	assert.Equal(t, len(watcher.reconcileRooms), 0)
+	_, ok = findRoomDirName(ctx, store, "!b:example.org")
+	assert.Assert(t, ok)
+	assert.Assert(t, !watcher.reconcileFailed)
+}